@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// defaultBindAddress keeps the web UI reachable only from this machine
+const defaultBindAddress = "127.0.0.1"
+
+// parseAllowedCIDRs parses the client allowlist. Plain IP addresses are
+// accepted as single-host prefixes.
+func parseAllowedCIDRs(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 allowed_cidrs 条目 %q: %v", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the address of the directly connected client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientAllowed reports whether the client address matches the allowlist.
+// An empty allowlist allows every client.
+func clientAllowed(r *http.Request, allowed []netip.Prefix) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuthorized checks the admin token, accepted either as a Bearer
+// token or as the password of HTTP Basic auth (any user name)
+func adminAuthorized(r *http.Request, token string) bool {
+	var given string
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		given = bearer
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// withAccessControl rejects clients outside the allowlist and, when an
+// admin token is configured, requests that do not present it
+func withAccessControl(next http.Handler, allowed []netip.Prefix, adminToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r, allowed) {
+			log.Printf("拒绝来自 %s 的访问: 不在允许的地址范围内", clientIP(r))
+			writeAccessError(w, http.StatusForbidden, "访问被拒绝")
+			return
+		}
+
+		if adminToken != "" && !isWebhookPath(r.URL.Path) && !adminAuthorized(r, adminToken) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="User API Demo", charset="UTF-8"`)
+			writeAccessError(w, http.StatusUnauthorized, "需要管理员密码")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAccessError writes an access error in the JSON envelope used by the UI
+func writeAccessError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   message,
+	})
+}
+
+// isLoopbackBind reports whether the bind address only accepts local clients
+func isLoopbackBind(bind string) bool {
+	if bind == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(bind)
+	return err == nil && addr.IsLoopback()
+}
+
+// displayHost returns the host name to print for the web UI address
+func displayHost(bind string) string {
+	if bind == "" || bind == "0.0.0.0" || bind == "::" {
+		return "localhost"
+	}
+	if strings.Contains(bind, ":") {
+		return "[" + bind + "]"
+	}
+	return bind
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password strength rules. The upper bound is in bytes because the
+// login service hashes passwords with bcrypt.
+const (
+	minPasswordLen = 8
+	maxPasswordLen = 72
+)
+
+// Verification codes are short alphanumeric strings
+const (
+	minVerificationCodeLen = 4
+	maxVerificationCodeLen = 16
+	maxEmailLen            = 254
+)
+
+// VerifyEmailRequest is the body of /api/jwt/email/verify
+type VerifyEmailRequest struct {
+	Code string `json:"code"`
+}
+
+// ChangePasswordRequest is the body of /api/jwt/change-password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordResetRequest is the body of /api/password/forgot. CaptchaID
+// is an ID already checked through /api/captcha/verify, as for login.
+type PasswordResetRequest struct {
+	Email     string `json:"email"`
+	CaptchaID string `json:"captcha_id,omitempty"`
+}
+
+// VerificationEmailSent is returned when a verification email is sent
+type VerificationEmailSent struct {
+	Email       string `json:"email"`
+	ExpiresIn   int    `json:"expires_in,omitempty"`   // Seconds the code stays valid
+	ResendAfter int    `json:"resend_after,omitempty"` // Seconds before another email can be sent
+}
+
+// EmailVerification is returned once a verification code is accepted
+type EmailVerification struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// PasswordChange is returned after a password change. The login service
+// may issue a new token because older ones are revoked.
+type PasswordChange struct {
+	Token string `json:"token,omitempty"`
+}
+
+// PasswordResetSent is returned when a reset email is requested. The
+// login service answers the same way whether or not the email exists.
+type PasswordResetSent struct {
+	Email     string `json:"email"`
+	ExpiresIn int    `json:"expires_in,omitempty"`
+}
+
+// validate trims and checks the verification code
+func (v *VerifyEmailRequest) validate() error {
+	v.Code = strings.TrimSpace(v.Code)
+	n := len(v.Code)
+	switch {
+	case v.Code == "":
+		return fieldErrors{"code": "请输入验证码"}
+	case n < minVerificationCodeLen || n > maxVerificationCodeLen:
+		return fieldErrors{"code": fmt.Sprintf("验证码应为 %d 到 %d 位", minVerificationCodeLen, maxVerificationCodeLen)}
+	case strings.IndexFunc(v.Code, notAlphanumeric) >= 0:
+		return fieldErrors{"code": "验证码只能包含字母和数字"}
+	}
+	return nil
+}
+
+// notAlphanumeric reports runes outside ASCII letters and digits
+func notAlphanumeric(r rune) bool {
+	return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// validate checks the new password against the strength rules.
+// Passwords are never trimmed.
+func (c *ChangePasswordRequest) validate() error {
+	errs := fieldErrors{}
+	if c.CurrentPassword == "" {
+		errs["current_password"] = "请输入当前密码"
+	}
+	if msg := passwordStrength(c.NewPassword); msg != "" {
+		errs["new_password"] = msg
+	} else if c.NewPassword == c.CurrentPassword {
+		errs["new_password"] = "新密码不能与当前密码相同"
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// passwordStrength returns why a password is too weak, or "" if it is
+// acceptable
+func passwordStrength(password string) string {
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsControl(r):
+			return "密码不能包含控制字符"
+		}
+	}
+	switch {
+	case password == "":
+		return "请输入新密码"
+	case utf8.RuneCountInString(password) < minPasswordLen:
+		return fmt.Sprintf("密码至少需要 %d 个字符", minPasswordLen)
+	case len(password) > maxPasswordLen:
+		return fmt.Sprintf("密码不能超过 %d 字节", maxPasswordLen)
+	case strings.TrimSpace(password) != password:
+		return "密码不能以空格开头或结尾"
+	case !letter || !digit:
+		return "密码必须同时包含字母和数字"
+	}
+	return ""
+}
+
+// validate trims and checks the email address
+func (p *PasswordResetRequest) validate() error {
+	p.Email = strings.TrimSpace(p.Email)
+	p.CaptchaID = strings.TrimSpace(p.CaptchaID)
+	if p.Email == "" {
+		return fieldErrors{"email": "请输入邮箱"}
+	}
+	addr, err := mail.ParseAddress(p.Email)
+	if err != nil || addr.Address != p.Email || len(p.Email) > maxEmailLen {
+		return fieldErrors{"email": "邮箱格式不正确"}
+	}
+	return nil
+}
+
+// verifyEmailBody decodes and validates a verification code
+func verifyEmailBody(r *http.Request) (interface{}, error) {
+	var req VerifyEmailRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// changePasswordBody decodes and validates a password change
+func changePasswordBody(r *http.Request) (interface{}, error) {
+	var req ChangePasswordRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// passwordResetBody decodes and validates a password reset request
+func passwordResetBody(r *http.Request) (interface{}, error) {
+	var req PasswordResetRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// cacheChangedPasswordToken caches the token issued with a password
+// change, if any
+func cacheChangedPasswordToken(r *http.Request, resp *APIResponse, result interface{}) {
+	if change, ok := result.(PasswordChange); ok && change.Token != "" {
+		setCachedToken(change.Token)
+	}
+}
@@ -0,0 +1,437 @@
+// Package analytics aggregates balance log entries and payment orders
+// into income/spend reports for the dashboard. It has no I/O so the
+// caller decides where the data comes from.
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Period is the bucket size of a report
+type Period string
+
+const (
+	Day   Period = "day"
+	Week  Period = "week" // ISO weeks starting on Monday
+	Month Period = "month"
+)
+
+// Default options
+const (
+	DefaultBurnWindow = 30 // Days of spending used for the burn rate
+	DefaultTop        = 5  // Number of top spending categories
+	maxBuckets        = 1000
+)
+
+// RechargeType is the entry/order type counted as a recharge
+const RechargeType = "recharge"
+
+// Entry is a balance change. Positive amounts are income, negative
+// amounts are spend.
+type Entry struct {
+	Time   time.Time
+	Type   string
+	Amount float64
+}
+
+// Order is a payment order
+type Order struct {
+	Time   time.Time
+	Type   string // Product type, e.g. recharge or vip
+	Amount float64
+	Paid   bool
+}
+
+// Options controls how a report is built
+type Options struct {
+	Period     Period
+	From, To   time.Time      // Inclusive day range; zero bounds use the data range
+	Location   *time.Location // Time zone of the buckets (default: local)
+	Now        time.Time      // Reference time for the projection (default: time.Now)
+	Balance    float64        // Current balance for the projection
+	BurnWindow int            // Days of spending used for the burn rate
+	Top        int            // Number of top spending categories
+}
+
+// Bucket totals one period
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Label  string    `json:"label"`
+	Income float64   `json:"income"`
+	Spend  float64   `json:"spend"` // Positive
+	Net    float64   `json:"net"`
+	Count  int       `json:"count"`
+}
+
+// TypeTotal totals one entry type
+type TypeTotal struct {
+	Type   string  `json:"type"`
+	Income float64 `json:"income"`
+	Spend  float64 `json:"spend"`
+	Count  int     `json:"count"`
+	Share  float64 `json:"share"` // Share of total spend, 0-1
+}
+
+// OrderBucket totals the payment orders of one period. Amounts only
+// count paid orders.
+type OrderBucket struct {
+	Start  time.Time          `json:"start"`
+	Label  string             `json:"label"`
+	Count  int                `json:"count"`
+	Paid   int                `json:"paid"`
+	Amount float64            `json:"amount"`
+	ByType map[string]float64 `json:"by_type"` // Paid amount per order type
+}
+
+// OrderTotal totals the payment orders of one type
+type OrderTotal struct {
+	Type    string  `json:"type"`
+	Count   int     `json:"count"`
+	Paid    int     `json:"paid"`
+	Amount  float64 `json:"amount"`  // Paid amount
+	Average float64 `json:"average"` // Average paid amount
+}
+
+// Recharges summarises paid recharge orders
+type Recharges struct {
+	Count   int     `json:"count"`
+	Total   float64 `json:"total"`
+	Average float64 `json:"average"`
+}
+
+// Projection estimates when the balance runs out at the recent burn rate
+type Projection struct {
+	Balance    float64    `json:"balance"`
+	WindowDays int        `json:"window_days"`
+	DailySpend float64    `json:"daily_spend"`
+	DaysLeft   *float64   `json:"days_left"`   // Nil when nothing is being spent
+	RunsOutAt  *time.Time `json:"runs_out_at"` // Nil when nothing is being spent
+}
+
+// Report is the aggregated view of entries and orders
+type Report struct {
+	Period      Period      `json:"period"`
+	Income      float64     `json:"income"`
+	Spend       float64     `json:"spend"`
+	Net         float64     `json:"net"`
+	Buckets     []Bucket    `json:"buckets"`
+	ByType      []TypeTotal `json:"by_type"`
+	TopSpending []TypeTotal `json:"top_spending"`
+	Recharges   Recharges   `json:"recharges"`
+	Projection  Projection  `json:"projection"`
+
+	OrderBuckets []OrderBucket `json:"order_buckets"`
+	OrdersByType []OrderTotal  `json:"orders_by_type"`
+}
+
+// ParsePeriod parses day, week or month, defaulting to day
+func ParsePeriod(s string) (Period, bool) {
+	switch Period(s) {
+	case "", Day:
+		return Day, true
+	case Week, Month:
+		return Period(s), true
+	}
+	return "", false
+}
+
+// Truncate returns the start of the period containing t
+func (p Period) Truncate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch p {
+	case Week:
+		// Go weeks start on Sunday; shift so Monday is day 0
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Next returns the start of the following period
+func (p Period) Next(start time.Time) time.Time {
+	switch p {
+	case Week:
+		return start.AddDate(0, 0, 7)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Label formats a period start for display
+func (p Period) Label(start time.Time) string {
+	switch p {
+	case Week:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case Month:
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// Build aggregates entries and orders into a report
+func Build(entries []Entry, orders []Order, opts Options) Report {
+	opts = withDefaults(opts)
+	r := Report{
+		Period:      opts.Period,
+		Buckets:     []Bucket{},
+		ByType:      []TypeTotal{},
+		TopSpending: []TypeTotal{},
+
+		OrderBuckets: []OrderBucket{},
+		OrdersByType: []OrderTotal{},
+	}
+
+	byType := make(map[string]*TypeTotal)
+	buckets := make(map[time.Time]*Bucket)
+	var first, last time.Time
+
+	for _, e := range entries {
+		t := e.Time.In(opts.Location)
+		if !inRange(t, opts) {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+
+		start := opts.Period.Truncate(t)
+		b := buckets[start]
+		if b == nil {
+			b = &Bucket{Start: start}
+			buckets[start] = b
+		}
+		tt := byType[e.Type]
+		if tt == nil {
+			tt = &TypeTotal{Type: e.Type}
+			byType[e.Type] = tt
+		}
+
+		b.Count++
+		tt.Count++
+		if e.Amount >= 0 {
+			b.Income += e.Amount
+			tt.Income += e.Amount
+			r.Income += e.Amount
+		} else {
+			b.Spend -= e.Amount
+			tt.Spend -= e.Amount
+			r.Spend -= e.Amount
+		}
+	}
+
+	r.Income, r.Spend = round2(r.Income), round2(r.Spend)
+	r.Net = round2(r.Income - r.Spend)
+	r.Buckets = fillBuckets(buckets, opts, first, last)
+
+	for _, tt := range byType {
+		tt.Income, tt.Spend = round2(tt.Income), round2(tt.Spend)
+		if r.Spend > 0 {
+			tt.Share = math.Round(tt.Spend/r.Spend*10000) / 10000
+		}
+		r.ByType = append(r.ByType, *tt)
+	}
+	sort.Slice(r.ByType, func(i, j int) bool { return r.ByType[i].Type < r.ByType[j].Type })
+
+	for _, tt := range r.ByType {
+		if tt.Spend > 0 {
+			r.TopSpending = append(r.TopSpending, tt)
+		}
+	}
+	sort.SliceStable(r.TopSpending, func(i, j int) bool { return r.TopSpending[i].Spend > r.TopSpending[j].Spend })
+	if len(r.TopSpending) > opts.Top {
+		r.TopSpending = r.TopSpending[:opts.Top]
+	}
+
+	r.OrderBuckets, r.OrdersByType = aggregateOrders(orders, opts)
+	for _, ot := range r.OrdersByType {
+		if ot.Type == RechargeType {
+			r.Recharges = Recharges{Count: ot.Paid, Total: ot.Amount, Average: ot.Average}
+		}
+	}
+
+	r.Projection = project(entries, opts)
+	return r
+}
+
+// aggregateOrders totals orders by period and by type
+func aggregateOrders(orders []Order, opts Options) ([]OrderBucket, []OrderTotal) {
+	byType := make(map[string]*OrderTotal)
+	buckets := make(map[time.Time]*OrderBucket)
+	var first, last time.Time
+
+	for _, o := range orders {
+		t := o.Time.In(opts.Location)
+		if !inRange(t, opts) {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+
+		start := opts.Period.Truncate(t)
+		b := buckets[start]
+		if b == nil {
+			b = &OrderBucket{Start: start, ByType: map[string]float64{}}
+			buckets[start] = b
+		}
+		ot := byType[o.Type]
+		if ot == nil {
+			ot = &OrderTotal{Type: o.Type}
+			byType[o.Type] = ot
+		}
+
+		b.Count++
+		ot.Count++
+		if o.Paid {
+			b.Paid++
+			b.Amount += o.Amount
+			b.ByType[o.Type] += o.Amount
+			ot.Paid++
+			ot.Amount += o.Amount
+		}
+	}
+
+	out := []OrderBucket{}
+	for _, start := range periodStarts(opts, first, last) {
+		b := OrderBucket{Start: start, ByType: map[string]float64{}}
+		if found := buckets[start]; found != nil {
+			b = *found
+		}
+		b.Label = opts.Period.Label(start)
+		b.Amount = round2(b.Amount)
+		for typ, amount := range b.ByType {
+			b.ByType[typ] = round2(amount)
+		}
+		out = append(out, b)
+	}
+
+	totals := []OrderTotal{}
+	for _, ot := range byType {
+		if ot.Paid > 0 {
+			ot.Average = round2(ot.Amount / float64(ot.Paid))
+		}
+		ot.Amount = round2(ot.Amount)
+		totals = append(totals, *ot)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Type < totals[j].Type })
+	return out, totals
+}
+
+// withDefaults fills in unset options
+func withDefaults(opts Options) Options {
+	if opts.Period == "" {
+		opts.Period = Day
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	if opts.BurnWindow <= 0 {
+		opts.BurnWindow = DefaultBurnWindow
+	}
+	if opts.Top <= 0 {
+		opts.Top = DefaultTop
+	}
+	return opts
+}
+
+// inRange reports whether t falls on a day inside the option range
+func inRange(t time.Time, opts Options) bool {
+	day := Day.Truncate(t)
+	if !opts.From.IsZero() && day.Before(dateIn(opts.From, opts.Location)) {
+		return false
+	}
+	if !opts.To.IsZero() && day.After(dateIn(opts.To, opts.Location)) {
+		return false
+	}
+	return true
+}
+
+// dateIn returns midnight in loc of the calendar date of t, so a date
+// parsed in UTC means the same day in the report time zone
+func dateIn(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// periodStarts lists the period starts from first to last, or from the
+// option range when it is set
+func periodStarts(opts Options, first, last time.Time) []time.Time {
+	if !opts.From.IsZero() {
+		first = dateIn(opts.From, opts.Location)
+	}
+	if !opts.To.IsZero() {
+		last = dateIn(opts.To, opts.Location)
+	}
+	var starts []time.Time
+	if first.IsZero() || last.IsZero() {
+		return starts
+	}
+
+	end := opts.Period.Truncate(last)
+	for start := opts.Period.Truncate(first); !start.After(end) && len(starts) < maxBuckets; start = opts.Period.Next(start) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// fillBuckets returns the buckets in order, adding empty ones so charts
+// have a continuous axis
+func fillBuckets(buckets map[time.Time]*Bucket, opts Options, first, last time.Time) []Bucket {
+	out := []Bucket{}
+	for _, start := range periodStarts(opts, first, last) {
+		b := Bucket{Start: start}
+		if found := buckets[start]; found != nil {
+			b = *found
+		}
+		b.Label = opts.Period.Label(start)
+		b.Income, b.Spend = round2(b.Income), round2(b.Spend)
+		b.Net = round2(b.Income - b.Spend)
+		out = append(out, b)
+	}
+	return out
+}
+
+// project estimates the days left from the average daily spend over the
+// burn window ending at Now
+func project(entries []Entry, opts Options) Projection {
+	p := Projection{Balance: opts.Balance, WindowDays: opts.BurnWindow}
+	since := opts.Now.AddDate(0, 0, -opts.BurnWindow)
+
+	var spend float64
+	for _, e := range entries {
+		if e.Amount < 0 && e.Time.After(since) && !e.Time.After(opts.Now) {
+			spend -= e.Amount
+		}
+	}
+	p.DailySpend = round2(spend / float64(opts.BurnWindow))
+	if p.DailySpend <= 0 {
+		return p
+	}
+
+	days := math.Max(0, opts.Balance) / (spend / float64(opts.BurnWindow))
+	days = math.Round(days*10) / 10
+	runsOut := opts.Now.Add(time.Duration(days * 24 * float64(time.Hour)))
+	p.DaysLeft, p.RunsOutAt = &days, &runsOut
+	return p
+}
+
+// round2 rounds to cents
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,365 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// at returns midnight UTC plus the given hour on a date
+func at(y int, m time.Month, d, hour int) time.Time {
+	return time.Date(y, m, d, hour, 0, 0, 0, time.UTC)
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name   string
+		period Period
+		in     time.Time
+		want   time.Time
+		label  string
+	}{
+		{"day", Day, at(2024, 3, 15, 18), at(2024, 3, 15, 0), "2024-03-15"},
+		{"week midweek", Week, at(2024, 3, 13, 9), at(2024, 3, 11, 0), "2024-W11"},
+		{"week on monday", Week, at(2024, 3, 11, 0), at(2024, 3, 11, 0), "2024-W11"},
+		{"week on sunday", Week, at(2024, 3, 17, 23), at(2024, 3, 11, 0), "2024-W11"},
+		{"week across month", Week, at(2024, 10, 2, 12), at(2024, 9, 30, 0), "2024-W40"},
+		{"week across year", Week, at(2025, 1, 1, 12), at(2024, 12, 30, 0), "2025-W01"},
+		{"sunday before new year", Week, at(2023, 12, 31, 12), at(2023, 12, 25, 0), "2023-W52"},
+		{"month", Month, at(2024, 2, 29, 23), at(2024, 2, 1, 0), "2024-02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.period.Truncate(tt.in)
+			if !got.Equal(tt.want) {
+				t.Errorf("Truncate(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+			if label := tt.period.Label(got); label != tt.label {
+				t.Errorf("Label(%v) = %q, want %q", got, label, tt.label)
+			}
+		})
+	}
+}
+
+func TestBuildBuckets(t *testing.T) {
+	type bucket struct {
+		Label         string
+		Income, Spend float64
+		Count         int
+	}
+	tests := []struct {
+		name    string
+		period  Period
+		entries []Entry
+		want    []bucket
+	}{
+		{
+			name:   "days fill gaps",
+			period: Day,
+			entries: []Entry{
+				{Time: at(2024, 3, 1, 10), Type: "recharge", Amount: 50},
+				{Time: at(2024, 3, 1, 20), Type: "api", Amount: -3.5},
+				{Time: at(2024, 3, 3, 8), Type: "api", Amount: -1.25},
+			},
+			want: []bucket{
+				{"2024-03-01", 50, 3.5, 2},
+				{"2024-03-02", 0, 0, 0},
+				{"2024-03-03", 0, 1.25, 1},
+			},
+		},
+		{
+			name:   "weeks across year boundary",
+			period: Week,
+			entries: []Entry{
+				{Time: at(2023, 12, 31, 12), Type: "api", Amount: -5},
+				{Time: at(2024, 1, 1, 0), Type: "recharge", Amount: 10},
+				{Time: at(2024, 1, 7, 23), Type: "api", Amount: -2},
+			},
+			want: []bucket{
+				{"2023-W52", 0, 5, 1},
+				{"2024-W01", 10, 2, 2},
+			},
+		},
+		{
+			name:   "weeks across month boundary",
+			period: Week,
+			entries: []Entry{
+				{Time: at(2024, 9, 29, 12), Type: "api", Amount: -1},
+				{Time: at(2024, 9, 30, 12), Type: "api", Amount: -2},
+				{Time: at(2024, 10, 6, 12), Type: "api", Amount: -3},
+			},
+			want: []bucket{
+				{"2024-W39", 0, 1, 1},
+				{"2024-W40", 0, 5, 2},
+			},
+		},
+		{
+			name:   "months fill gaps",
+			period: Month,
+			entries: []Entry{
+				{Time: at(2024, 1, 31, 23), Type: "recharge", Amount: 100},
+				{Time: at(2024, 3, 1, 0), Type: "api", Amount: -40},
+			},
+			want: []bucket{
+				{"2024-01", 100, 0, 1},
+				{"2024-02", 0, 0, 0},
+				{"2024-03", 0, 40, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Build(tt.entries, nil, Options{Period: tt.period, Location: time.UTC, Now: at(2025, 1, 1, 0)})
+			var got []bucket
+			for _, b := range r.Buckets {
+				got = append(got, bucket{b.Label, b.Income, b.Spend, b.Count})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRange(t *testing.T) {
+	entries := []Entry{
+		{Time: at(2024, 2, 28, 12), Type: "api", Amount: -1},
+		{Time: at(2024, 3, 1, 12), Type: "api", Amount: -2},
+		{Time: at(2024, 3, 31, 23), Type: "api", Amount: -4},
+		{Time: at(2024, 4, 1, 0), Type: "api", Amount: -8},
+	}
+	r := Build(entries, nil, Options{
+		Period:   Week,
+		From:     at(2024, 3, 1, 0),
+		To:       at(2024, 3, 31, 0),
+		Location: time.UTC,
+		Now:      at(2025, 1, 1, 0),
+	})
+	if r.Spend != 6 {
+		t.Errorf("spend = %v, want 6", r.Spend)
+	}
+	// 2024-03-01 is a Friday, 2024-03-31 a Sunday
+	if first, last := r.Buckets[0].Label, r.Buckets[len(r.Buckets)-1].Label; first != "2024-W09" || last != "2024-W13" {
+		t.Errorf("buckets span %s..%s, want 2024-W09..2024-W13", first, last)
+	}
+}
+
+func TestBuildByType(t *testing.T) {
+	entries := []Entry{
+		{Time: at(2024, 5, 1, 0), Type: "recharge", Amount: 100},
+		{Time: at(2024, 5, 2, 0), Type: "api", Amount: -30},
+		{Time: at(2024, 5, 3, 0), Type: "vip", Amount: -60},
+		{Time: at(2024, 5, 4, 0), Type: "refund", Amount: 5},
+		{Time: at(2024, 5, 5, 0), Type: "api", Amount: -10},
+		{Time: at(2024, 5, 6, 0), Type: "storage", Amount: -20},
+		{Time: at(2024, 5, 7, 0), Type: "sms", Amount: -0.5},
+	}
+	tests := []struct {
+		name    string
+		top     int
+		wantTop []string
+	}{
+		{"default limit", 0, []string{"vip", "api", "storage", "sms"}},
+		{"limited", 2, []string{"vip", "api"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Build(entries, nil, Options{Location: time.UTC, Now: at(2025, 1, 1, 0), Top: tt.top})
+
+			if r.Income != 105 || r.Spend != 120.5 || r.Net != -15.5 {
+				t.Errorf("income/spend/net = %v/%v/%v, want 105/120.5/-15.5", r.Income, r.Spend, r.Net)
+			}
+
+			wantTypes := map[string]TypeTotal{
+				"api":      {Type: "api", Spend: 40, Count: 2, Share: 0.332},
+				"recharge": {Type: "recharge", Income: 100, Count: 1},
+				"refund":   {Type: "refund", Income: 5, Count: 1},
+				"sms":      {Type: "sms", Spend: 0.5, Count: 1, Share: 0.0041},
+				"storage":  {Type: "storage", Spend: 20, Count: 1, Share: 0.166},
+				"vip":      {Type: "vip", Spend: 60, Count: 1, Share: 0.4979},
+			}
+			if len(r.ByType) != len(wantTypes) {
+				t.Fatalf("by_type has %d types, want %d", len(r.ByType), len(wantTypes))
+			}
+			for i, got := range r.ByType {
+				if i > 0 && r.ByType[i-1].Type >= got.Type {
+					t.Errorf("by_type not sorted by type: %q before %q", r.ByType[i-1].Type, got.Type)
+				}
+				if want := wantTypes[got.Type]; got != want {
+					t.Errorf("by_type[%s] = %+v, want %+v", got.Type, got, want)
+				}
+			}
+
+			var top []string
+			for _, tt := range r.TopSpending {
+				top = append(top, tt.Type)
+			}
+			if !reflect.DeepEqual(top, tt.wantTop) {
+				t.Errorf("top spending = %v, want %v", top, tt.wantTop)
+			}
+		})
+	}
+}
+
+func TestBuildOrders(t *testing.T) {
+	orders := []Order{
+		{Time: at(2024, 1, 5, 0), Type: "recharge", Amount: 10, Paid: true},
+		{Time: at(2024, 1, 9, 0), Type: "recharge", Amount: 25, Paid: true},
+		{Time: at(2024, 1, 9, 0), Type: "recharge", Amount: 1000, Paid: false},
+		{Time: at(2024, 1, 20, 0), Type: "vip", Amount: 30, Paid: true},
+		{Time: at(2024, 3, 2, 0), Type: "recharge", Amount: 20.01, Paid: true},
+	}
+	tests := []struct {
+		name          string
+		opts          Options
+		wantRecharges Recharges
+		wantBuckets   []OrderBucket
+		wantTypes     []OrderTotal
+	}{
+		{
+			name:          "by month",
+			opts:          Options{Period: Month},
+			wantRecharges: Recharges{Count: 3, Total: 55.01, Average: 18.34},
+			wantBuckets: []OrderBucket{
+				{Label: "2024-01", Count: 4, Paid: 3, Amount: 65, ByType: map[string]float64{"recharge": 35, "vip": 30}},
+				{Label: "2024-02", ByType: map[string]float64{}},
+				{Label: "2024-03", Count: 1, Paid: 1, Amount: 20.01, ByType: map[string]float64{"recharge": 20.01}},
+			},
+			wantTypes: []OrderTotal{
+				{Type: "recharge", Count: 4, Paid: 3, Amount: 55.01, Average: 18.34},
+				{Type: "vip", Count: 1, Paid: 1, Amount: 30, Average: 30},
+			},
+		},
+		{
+			name:          "range excludes orders",
+			opts:          Options{Period: Month, From: at(2024, 1, 6, 0), To: at(2024, 1, 31, 0)},
+			wantRecharges: Recharges{Count: 1, Total: 25, Average: 25},
+			wantBuckets: []OrderBucket{
+				{Label: "2024-01", Count: 3, Paid: 2, Amount: 55, ByType: map[string]float64{"recharge": 25, "vip": 30}},
+			},
+			wantTypes: []OrderTotal{
+				{Type: "recharge", Count: 2, Paid: 1, Amount: 25, Average: 25},
+				{Type: "vip", Count: 1, Paid: 1, Amount: 30, Average: 30},
+			},
+		},
+		{
+			name:          "single day with unpaid order",
+			opts:          Options{Period: Day, From: at(2024, 1, 9, 0), To: at(2024, 1, 9, 0)},
+			wantBuckets:   []OrderBucket{{Label: "2024-01-09", Count: 2, Paid: 1, Amount: 25, ByType: map[string]float64{"recharge": 25}}},
+			wantTypes:     []OrderTotal{{Type: "recharge", Count: 2, Paid: 1, Amount: 25, Average: 25}},
+			wantRecharges: Recharges{Count: 1, Total: 25, Average: 25},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Location, tt.opts.Now = time.UTC, at(2025, 1, 1, 0)
+			r := Build(nil, orders, tt.opts)
+
+			if r.Recharges != tt.wantRecharges {
+				t.Errorf("recharges = %+v, want %+v", r.Recharges, tt.wantRecharges)
+			}
+			for i := range r.OrderBuckets {
+				r.OrderBuckets[i].Start = time.Time{}
+			}
+			if !reflect.DeepEqual(r.OrderBuckets, tt.wantBuckets) {
+				t.Errorf("order buckets = %+v, want %+v", r.OrderBuckets, tt.wantBuckets)
+			}
+			if !reflect.DeepEqual(r.OrdersByType, tt.wantTypes) {
+				t.Errorf("orders by type = %+v, want %+v", r.OrdersByType, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestBuildProjection(t *testing.T) {
+	now := at(2024, 6, 30, 12)
+	tests := []struct {
+		name      string
+		balance   float64
+		window    int
+		entries   []Entry
+		wantDaily float64
+		wantDays  *float64
+	}{
+		{
+			name:    "steady spend",
+			balance: 100,
+			window:  10,
+			entries: []Entry{
+				{Time: now.AddDate(0, 0, -2), Type: "api", Amount: -30},
+				{Time: now.AddDate(0, 0, -9), Type: "api", Amount: -20},
+				{Time: now.AddDate(0, 0, -11), Type: "api", Amount: -500}, // Outside the window
+				{Time: now.AddDate(0, 0, 1), Type: "api", Amount: -500},   // After now
+				{Time: now.AddDate(0, 0, -1), Type: "recharge", Amount: 80},
+			},
+			wantDaily: 5,
+			wantDays:  ptr(20),
+		},
+		{
+			name:      "rounded days",
+			balance:   10,
+			window:    30,
+			entries:   []Entry{{Time: now.AddDate(0, 0, -1), Type: "api", Amount: -90}},
+			wantDaily: 3,
+			wantDays:  ptr(3.3),
+		},
+		{
+			name:      "negative balance",
+			balance:   -5,
+			window:    7,
+			entries:   []Entry{{Time: now.AddDate(0, 0, -1), Type: "api", Amount: -7}},
+			wantDaily: 1,
+			wantDays:  ptr(0),
+		},
+		{
+			name:    "no spend",
+			balance: 50,
+			window:  30,
+			entries: []Entry{{Time: now.AddDate(0, 0, -1), Type: "recharge", Amount: 50}},
+		},
+		{
+			name:    "spend rounds to zero",
+			balance: 50,
+			window:  30,
+			entries: []Entry{{Time: now.AddDate(0, 0, -1), Type: "api", Amount: -0.1}},
+		},
+		{
+			name:    "no entries",
+			balance: 50,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Build(tt.entries, nil, Options{Location: time.UTC, Now: now, Balance: tt.balance, BurnWindow: tt.window})
+			p := r.Projection
+
+			wantWindow := tt.window
+			if wantWindow == 0 {
+				wantWindow = DefaultBurnWindow
+			}
+			if p.Balance != tt.balance || p.WindowDays != wantWindow || p.DailySpend != tt.wantDaily {
+				t.Errorf("projection = %+v, want balance %v, window %d, daily %v", p, tt.balance, wantWindow, tt.wantDaily)
+			}
+			switch {
+			case tt.wantDays == nil:
+				if p.DaysLeft != nil || p.RunsOutAt != nil {
+					t.Errorf("days left = %v, runs out %v, want nil", p.DaysLeft, p.RunsOutAt)
+				}
+			case p.DaysLeft == nil || p.RunsOutAt == nil:
+				t.Fatalf("days left is nil, want %v", *tt.wantDays)
+			default:
+				if *p.DaysLeft != *tt.wantDays {
+					t.Errorf("days left = %v, want %v", *p.DaysLeft, *tt.wantDays)
+				}
+				want := now.Add(time.Duration(*tt.wantDays * 24 * float64(time.Hour)))
+				if !p.RunsOutAt.Equal(want) {
+					t.Errorf("runs out at %v, want %v", p.RunsOutAt, want)
+				}
+			}
+		})
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Audit log defaults
+const (
+	defaultAuditLog     = "audit.jsonl"
+	maxAuditPage        = 200
+	maxAuditValueLen    = 64 // Longer strings are cut in request summaries
+	auditRedacted       = "***"
+	auditGenesisHash    = "0000000000000000000000000000000000000000000000000000000000000000"
+	auditSessionHashLen = 12
+)
+
+// Audited actions
+const (
+	auditConfigSave      = "config.save"
+	auditTokenExchange   = "login.api_key"
+	auditLogin           = "login.password"
+	auditRegister        = "register"
+	auditProfileUpdate   = "profile.update"
+	auditAvatarUpload    = "profile.avatar"
+	auditEmailResend     = "email.resend_verification"
+	auditEmailVerify     = "email.verify"
+	auditPasswordChange  = "password.change"
+	auditPasswordForgot  = "password.forgot"
+	auditMessageRead     = "message.read"
+	auditMessageDelete   = "message.delete"
+	auditMessagesReadAll = "messages.read_all"
+	auditVIPPurchase     = "vip.purchase"
+	auditRecharge        = "recharge"
+	auditVIPAutoRenew    = "vip.auto_renew"        // Recorded by the VIP scheduler
+	auditRuleRecharge    = "balance_rule.recharge" // Recorded by the balance rules
+)
+
+// auditSensitive lists request fields whose values are never logged.
+// Names are matched case-insensitively as substrings.
+var auditSensitive = []string{"password", "token", "secret", "api_key", "captcha", "code"}
+
+// auditEntry is one line of the audit log. Hash covers every other
+// field, including PrevHash, so editing, removing or reordering lines
+// breaks the chain.
+type auditEntry struct {
+	Seq      uint64                 `json:"seq"`
+	Time     time.Time              `json:"time"`
+	Session  string                 `json:"session"`   // Fingerprint of the JWT token in use, empty without one
+	ClientIP string                 `json:"client_ip"` // Empty for background actions
+	Action   string                 `json:"action"`
+	Request  map[string]interface{} `json:"request,omitempty"` // Redacted summary
+	Status   int                    `json:"status"`
+	Success  bool                   `json:"success"`
+	Message  string                 `json:"message,omitempty"` // Upstream message or error
+	PrevHash string                 `json:"prev_hash"`
+	Hash     string                 `json:"hash"`
+}
+
+// computeHash returns the chain hash of an entry
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLog appends entries to a JSON Lines file, keeping the sequence
+// number and hash of the last entry in memory
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	seq      uint64
+	lastHash string
+	tornLine int // Line of a partial entry dropped at startup, 0 if none
+}
+
+// audit is the audit log, nil when disabled
+var audit *auditLog
+
+// openAuditLog opens the log and reads the end of its chain. A last
+// line left without its newline by an interrupted write is dropped
+// first; any other line that cannot be parsed stays in the file and
+// fails verification.
+func openAuditLog(path string) (*auditLog, error) {
+	l := &auditLog{path: path, lastHash: auditGenesisHash}
+	torn, err := l.dropTornTail()
+	if err != nil {
+		return nil, fmt.Errorf("修复审计日志 %s 失败: %v", path, err)
+	}
+
+	lines := 0
+	var bad []int
+	err = l.scan(func(line int, e auditEntry, err error) bool {
+		lines = line
+		if err != nil {
+			bad = append(bad, line)
+			return true
+		}
+		l.seq, l.lastHash = e.Seq, e.Hash
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("读取审计日志 %s 失败: %v", path, err)
+	}
+	if torn > 0 {
+		l.tornLine = lines + 1
+		log.Printf("警告: 审计日志 %s 第 %d 行写入中断，已移除未写完的 %d 字节", path, l.tornLine, torn)
+	}
+	if len(bad) > 0 {
+		log.Printf("警告: 审计日志 %s 第 %v 行无法解析，校验将失败", path, bad)
+	}
+	return l, nil
+}
+
+// dropTornTail truncates a last line that has no newline and does not
+// parse, which is what a crash in the middle of append leaves behind,
+// and returns the number of bytes removed. A complete entry missing
+// only its newline is terminated instead.
+func (l *auditLog) dropTornTail() (int64, error) {
+	f, err := os.OpenFile(l.path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	size := info.Size()
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return 0, nil
+	}
+
+	// Walk back to the start of the last line
+	start := int64(0)
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		off := max(end-int64(len(buf)), 0)
+		n, err := f.ReadAt(buf[:end-off], off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			start = off + int64(i) + 1
+			break
+		}
+		end = off
+	}
+
+	tail := make([]byte, size-start)
+	if _, err := f.ReadAt(tail, start); err != nil {
+		return 0, err
+	}
+	var e auditEntry
+	if json.Unmarshal(tail, &e) == nil {
+		_, err = f.WriteAt([]byte{'\n'}, size)
+		return 0, err
+	}
+	if err := f.Truncate(start); err != nil {
+		return 0, err
+	}
+	return size - start, f.Sync()
+}
+
+// scan calls fn with every line in order until it returns false. err
+// is set for a line that cannot be parsed. A missing file is an empty
+// log.
+func (l *auditLog) scan(fn func(line int, e auditEntry, err error) bool) error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if !fn(line, e, err) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// append chains an entry to the log and writes it to disk
+func (l *auditLog) append(e auditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.PrevHash = l.lastHash
+	e.Hash = e.computeHash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	l.seq, l.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// auditVerification is the result of checking the hash chain
+type auditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  uint64 `json:"entries"`
+	BrokenAt uint64 `json:"broken_at,omitempty"` // Line of the first entry that does not match
+	Reason   string `json:"reason,omitempty"`
+	TornLine int    `json:"torn_line,omitempty"` // Partial last line dropped at startup
+}
+
+// verify recomputes the chain from the start of the file. Every line
+// must be a chained entry.
+func (l *auditLog) verify() auditVerification {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v := auditVerification{Valid: true, TornLine: l.tornLine}
+	prev := auditGenesisHash
+	err := l.scan(func(line int, e auditEntry, err error) bool {
+		switch {
+		case err != nil:
+			v.Reason = fmt.Sprintf("无法解析: %v", err)
+		case e.Seq != v.Entries+1:
+			v.Reason = fmt.Sprintf("序号应为 %d，实际为 %d", v.Entries+1, e.Seq)
+		case e.PrevHash != prev:
+			v.Reason = "prev_hash 与上一条记录不一致"
+		case e.computeHash() != e.Hash:
+			v.Reason = "记录内容与 hash 不一致"
+		default:
+			v.Entries++
+			prev = e.Hash
+			return true
+		}
+		v.Valid, v.BrokenAt = false, uint64(line)
+		return false
+	})
+	if err != nil && v.Valid {
+		v.Valid, v.BrokenAt, v.Reason = false, v.Entries+1, err.Error()
+	}
+	if v.Valid && prev != l.lastHash {
+		v.Valid, v.Reason = false, "日志末尾的记录已被删除"
+	}
+	return v
+}
+
+// sessionFingerprint identifies a login session without storing the token
+func sessionFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:auditSessionHashLen]
+}
+
+// isSensitiveField reports whether a field's value must not be logged
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range auditSensitive {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue summarizes a request value: sensitive fields are masked,
+// long strings cut and nested objects reduced the same way
+func redactValue(name string, v interface{}) interface{} {
+	if isSensitiveField(name) {
+		return auditRedacted
+	}
+	switch v := v.(type) {
+	case string:
+		if utf8.RuneCountInString(v) > maxAuditValueLen {
+			return string([]rune(v)[:maxAuditValueLen]) + "…"
+		}
+		return v
+	case map[string]interface{}:
+		return redactFields(v)
+	case []interface{}:
+		return fmt.Sprintf("[%d 项]", len(v))
+	}
+	return v
+}
+
+// redactFields applies redactValue to every field
+func redactFields(fields map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(fields))
+	for name, v := range fields {
+		out[name] = redactValue(name, v)
+	}
+	return out
+}
+
+// redactForm summarizes form values
+func redactForm(form url.Values) map[string]interface{} {
+	out := make(map[string]interface{}, len(form))
+	for name, values := range form {
+		if name == csrfFormField {
+			continue
+		}
+		out[name] = redactValue(name, strings.Join(values, ","))
+	}
+	return out
+}
+
+// requestSummary builds the redacted summary of a JSON body and the
+// path values of the route
+func requestSummary(r *http.Request, body []byte) map[string]interface{} {
+	summary := map[string]interface{}{}
+	var fields map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &fields) == nil {
+		summary = redactFields(fields)
+	}
+	if id := r.PathValue("id"); id != "" {
+		summary["id"] = id
+	}
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		summary["idempotency_key"] = redactValue("", key)
+	}
+	if len(summary) == 0 {
+		return nil
+	}
+	return summary
+}
+
+// recordAudit appends an entry. ip is empty for actions the demo takes
+// on its own. Failures to write are logged; they never fail the action
+// itself.
+func recordAudit(ip, session, action string, summary map[string]interface{}, status int, success bool, message string) {
+	if audit == nil {
+		return
+	}
+	e := auditEntry{
+		Time:     time.Now(),
+		Session:  session,
+		ClientIP: ip,
+		Action:   action,
+		Request:  summary,
+		Status:   status,
+		Success:  success,
+		Message:  message,
+	}
+	if err := audit.append(e); err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// serveAudited runs next and records the action with the status and
+// message of the JSON response it wrote. JSON bodies are read up to
+// maxBufferedBody for the summary; other bodies such as uploads are left
+// to next and only their content type and size are recorded.
+func serveAudited(w http.ResponseWriter, r *http.Request, action string, next func(w http.ResponseWriter, r *http.Request)) {
+	if audit == nil {
+		next(w, r)
+		return
+	}
+
+	var body []byte
+	captured := isJSONBody(r)
+	if captured {
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxBufferedBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			apiErr := newAPIError(http.StatusRequestEntityTooLarge, "请求体过大")
+			summary := map[string]interface{}{"content_type": redactValue("", mediaType(r)), "size": r.ContentLength}
+			recordAudit(clientIP(r), sessionFingerprint(getCachedToken()), action, summary, apiErr.Status, false, apiErr.Message)
+			writeError(w, apiErr)
+			return
+		case err != nil:
+			writeError(w, errInvalidBody)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	session := sessionFingerprint(getCachedToken())
+
+	rec := &recordingWriter{ResponseWriter: w}
+	next(rec, r)
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var result struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	json.Unmarshal(rec.body.Bytes(), &result)
+	message := result.Message
+	if message == "" {
+		message = result.Error
+	}
+	summary := requestSummary(r, body)
+	if !captured {
+		if summary == nil {
+			summary = map[string]interface{}{}
+		}
+		summary["content_type"] = redactValue("", mediaType(r))
+		if r.ContentLength >= 0 {
+			summary["size"] = r.ContentLength
+		}
+	}
+	recordAudit(clientIP(r), session, action, summary, status, result.Success && status < 300, message)
+}
+
+// isJSONBody reports whether the request body is JSON or empty. Bodies
+// without a content type are treated as JSON, as the handlers decode
+// them that way.
+func isJSONBody(r *http.Request) bool {
+	t := mediaType(r)
+	return t == "" || r.ContentLength == 0 || t == "application/json" || strings.HasSuffix(t, "+json")
+}
+
+// mediaType returns the request content type without parameters such as
+// the multipart boundary
+func mediaType(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	return contentType
+}
+
+// handleAudit renders the audit log page
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	data := PageData{
+		Config:    *currentConfig(),
+		HasToken:  getCachedToken() != "",
+		CSRFToken: ensureCSRFToken(w, r),
+	}
+
+	renderTemplate(w, "audit.html", data)
+}
+
+// handleAuditEntries returns a page of entries, newest first, with the
+// result of verifying the chain. Query: page, page_size, action.
+func handleAuditEntries(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		writeError(w, newAPIError(http.StatusNotFound, "审计日志未启用"))
+		return
+	}
+
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(q.Get("page_size"))
+	if pageSize < 1 || pageSize > maxAuditPage {
+		pageSize = 50
+	}
+	action := q.Get("action")
+
+	var entries []auditEntry
+	audit.mu.Lock()
+	err := audit.scan(func(line int, e auditEntry, err error) bool {
+		if err == nil && (action == "" || e.Action == action) {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	audit.mu.Unlock()
+	if err != nil {
+		writeError(w, newAPIError(http.StatusInternalServerError, "读取审计日志失败: %v", err))
+		return
+	}
+
+	total := len(entries)
+	out := []auditEntry{}
+	for i := total - 1 - (page-1)*pageSize; i >= 0 && len(out) < pageSize; i-- {
+		out = append(out, entries[i])
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data": map[string]interface{}{
+			"entries":      out,
+			"total":        total,
+			"page":         page,
+			"page_size":    pageSize,
+			"verification": audit.verify(),
+		},
+	})
+}
+
+// handleAuditExport downloads the log file as JSON Lines
+func handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		writeError(w, newAPIError(http.StatusNotFound, "审计日志未启用"))
+		return
+	}
+
+	audit.mu.Lock()
+	data, err := os.ReadFile(audit.path)
+	audit.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, newAPIError(http.StatusInternalServerError, "读取审计日志失败: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "audit-"+time.Now().Format("20060102-150405")+".jsonl"))
+	w.Write(data)
+}
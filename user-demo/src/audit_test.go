@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAuditLog appends n entries to a new log and returns its path
+func writeAuditLog(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := l.append(auditEntry{Action: auditRecharge, Status: 200, Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// appendRaw writes data to the end of the file as is
+func appendRaw(t *testing.T, path string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	const torn = `{"seq":4,"time":"2026-10-18T09:00:00Z","act`
+
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string)
+		want   auditVerification
+	}{
+		{
+			name:   "intact",
+			damage: func(t *testing.T, path string) {},
+			want:   auditVerification{Valid: true, Entries: 3},
+		},
+		{
+			name:   "torn last line is dropped",
+			damage: func(t *testing.T, path string) { appendRaw(t, path, torn) },
+			want:   auditVerification{Valid: true, Entries: 3, TornLine: 4},
+		},
+		{
+			name: "complete last entry without newline is kept",
+			damage: func(t *testing.T, path string) {
+				data, _ := os.ReadFile(path)
+				os.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0600)
+			},
+			want: auditVerification{Valid: true, Entries: 3},
+		},
+		{
+			name: "unparsable line in the middle",
+			damage: func(t *testing.T, path string) {
+				data, _ := os.ReadFile(path)
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				lines[1] = []byte("garbage\n")
+				os.WriteFile(path, bytes.Join(lines, nil), 0600)
+			},
+			want: auditVerification{BrokenAt: 2, Entries: 1},
+		},
+		{
+			name:   "torn line followed by later appends",
+			damage: func(t *testing.T, path string) { appendRaw(t, path, torn+"\n") },
+			want:   auditVerification{BrokenAt: 4, Entries: 3},
+		},
+		{
+			name:   "unparsable newline-terminated last line",
+			damage: func(t *testing.T, path string) { appendRaw(t, path, "garbage\n") },
+			want:   auditVerification{BrokenAt: 4, Entries: 3},
+		},
+		{
+			name: "edited entry",
+			damage: func(t *testing.T, path string) {
+				data, _ := os.ReadFile(path)
+				os.WriteFile(path, bytes.Replace(data, []byte(`"status":200`), []byte(`"status":500`), 1), 0600)
+			},
+			want: auditVerification{BrokenAt: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeAuditLog(t, 3)
+			tt.damage(t, path)
+
+			l, err := openAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := l.verify()
+			got.Reason = ""
+			if got != tt.want {
+				t.Errorf("verify = %+v, want %+v", got, tt.want)
+			}
+
+			// New entries chain on from the last complete one
+			if err := l.append(auditEntry{Action: auditRecharge}); err != nil {
+				t.Fatal(err)
+			}
+			if after := l.verify(); after.Valid != tt.want.Valid {
+				t.Errorf("valid after append = %v, want %v (%s)", after.Valid, tt.want.Valid, after.Reason)
+			}
+		})
+	}
+}
+
+func TestAuditLogVerifyDeletedTail(t *testing.T) {
+	path := writeAuditLog(t, 0)
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.append(auditEntry{Action: auditRecharge}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if err := os.WriteFile(path, bytes.Join(lines[:2], nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v := l.verify(); v.Valid {
+		t.Errorf("verify = %+v after deleting the last entry, want invalid", v)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// balanceEpsilon is the tolerance when comparing amounts
+const balanceEpsilon = 0.005
+
+// Export formats
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+// logRange is an inclusive date range; zero bounds are open
+type logRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseLogRange parses optional from/to dates (YYYY-MM-DD)
+func parseLogRange(from, to string) (logRange, error) {
+	var rng logRange
+	var err error
+	if from != "" {
+		if rng.From, err = time.Parse(dateLayout, from); err != nil {
+			return rng, newAPIError(http.StatusBadRequest, "from 格式应为 YYYY-MM-DD")
+		}
+	}
+	if to != "" {
+		if rng.To, err = time.Parse(dateLayout, to); err != nil {
+			return rng, newAPIError(http.StatusBadRequest, "to 格式应为 YYYY-MM-DD")
+		}
+	}
+	if !rng.From.IsZero() && !rng.To.IsZero() && rng.To.Before(rng.From) {
+		return rng, newAPIError(http.StatusBadRequest, "to 不能早于 from")
+	}
+	return rng, nil
+}
+
+// contains reports whether t falls on a day inside the range
+func (rng logRange) contains(t time.Time) bool {
+	day := t.Format(dateLayout)
+	if !rng.From.IsZero() && day < rng.From.Format(dateLayout) {
+		return false
+	}
+	if !rng.To.IsZero() && day > rng.To.Format(dateLayout) {
+		return false
+	}
+	return true
+}
+
+// query returns the upstream date filters for the range
+func (rng logRange) query() url.Values {
+	q := url.Values{}
+	if !rng.From.IsZero() {
+		q.Set("start_date", rng.From.Format(dateLayout))
+	}
+	if !rng.To.IsZero() {
+		q.Set("end_date", rng.To.Format(dateLayout))
+	}
+	return q
+}
+
+// fetchAllBalanceLogs walks every balance log page in the range and
+// returns the entries oldest first, with the total reported upstream
+func fetchAllBalanceLogs(rng logRange) ([]BalanceLog, int64, error) {
+	var logs []BalanceLog
+	var total int64
+	err := walkPages("/api/auth/user-logs/balance", rng.query(), func(data json.RawMessage) (int, int64, error) {
+		var page BalanceLogsResponse
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, 0, err
+		}
+		// Filter locally as well in case upstream ignores the dates
+		for _, entry := range page.Logs {
+			if rng.contains(entry.CreatedAt) {
+				logs = append(logs, entry)
+			}
+		}
+		total = page.Total
+		return len(page.Logs), page.Total, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(logs, func(i, j int) bool {
+		if !logs[i].CreatedAt.Equal(logs[j].CreatedAt) {
+			return logs[i].CreatedAt.Before(logs[j].CreatedAt)
+		}
+		return logs[i].ID < logs[j].ID
+	})
+	return logs, total, nil
+}
+
+// statementRow is a balance log entry with its running total
+type statementRow struct {
+	BalanceLog
+	RunningBalance float64 `json:"running_balance"`
+	Mismatch       bool    `json:"mismatch,omitempty"` // Running total differs from balance_after
+}
+
+// typeSummary totals credits and debits for one log type
+type typeSummary struct {
+	Type    string  `json:"type"`
+	Count   int     `json:"count"`
+	Credits float64 `json:"credits"`
+	Debits  float64 `json:"debits"` // Negative or zero
+	Net     float64 `json:"net"`
+}
+
+// statementSummary is the footer of a balance statement
+type statementSummary struct {
+	From           string        `json:"from,omitempty"`
+	To             string        `json:"to,omitempty"`
+	Count          int           `json:"count"`
+	OpeningBalance float64       `json:"opening_balance"`
+	ClosingBalance float64       `json:"closing_balance"`
+	Credits        float64       `json:"credits"`
+	Debits         float64       `json:"debits"`
+	Mismatches     int           `json:"mismatches"`
+	ByType         []typeSummary `json:"by_type"`
+}
+
+// balanceStatement is every balance change in a range with totals
+type balanceStatement struct {
+	Rows    []statementRow
+	Summary statementSummary
+}
+
+// buildStatement computes running totals from the opening balance and
+// checks them against each entry's BalanceAfter. After a mismatch the
+// running total resynchronises to BalanceAfter so each discrepancy is
+// reported once.
+func buildStatement(logs []BalanceLog, rng logRange) *balanceStatement {
+	st := &balanceStatement{Rows: make([]statementRow, 0, len(logs))}
+	sum := &st.Summary
+	if !rng.From.IsZero() {
+		sum.From = rng.From.Format(dateLayout)
+	}
+	if !rng.To.IsZero() {
+		sum.To = rng.To.Format(dateLayout)
+	}
+	if len(logs) == 0 {
+		sum.ByType = []typeSummary{}
+		return st
+	}
+
+	byType := make(map[string]*typeSummary)
+	sum.OpeningBalance = round2(logs[0].BalanceAfter - logs[0].Amount)
+	running := sum.OpeningBalance
+
+	for _, entry := range logs {
+		running = round2(running + entry.Amount)
+		row := statementRow{BalanceLog: entry, RunningBalance: running}
+		if math.Abs(running-entry.BalanceAfter) > balanceEpsilon {
+			row.Mismatch = true
+			sum.Mismatches++
+			running = entry.BalanceAfter
+		}
+		st.Rows = append(st.Rows, row)
+
+		ts := byType[entry.Type]
+		if ts == nil {
+			ts = &typeSummary{Type: entry.Type}
+			byType[entry.Type] = ts
+		}
+		ts.Count++
+		if entry.Amount >= 0 {
+			ts.Credits = round2(ts.Credits + entry.Amount)
+			sum.Credits = round2(sum.Credits + entry.Amount)
+		} else {
+			ts.Debits = round2(ts.Debits + entry.Amount)
+			sum.Debits = round2(sum.Debits + entry.Amount)
+		}
+		ts.Net = round2(ts.Credits + ts.Debits)
+	}
+
+	sum.Count = len(logs)
+	sum.ClosingBalance = logs[len(logs)-1].BalanceAfter
+	for _, ts := range byType {
+		sum.ByType = append(sum.ByType, *ts)
+	}
+	sort.Slice(sum.ByType, func(i, j int) bool { return sum.ByType[i].Type < sum.ByType[j].Type })
+	return st
+}
+
+// round2 rounds to cents to keep float sums stable
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// writeStatement writes the statement in the given format
+func writeStatement(w io.Writer, st *balanceStatement, format string) error {
+	switch format {
+	case formatJSONL:
+		return writeStatementJSONL(w, st)
+	default:
+		return writeStatementCSV(w, st)
+	}
+}
+
+// writeStatementJSONL writes one JSON object per entry followed by a
+// {"summary": ...} line
+func writeStatementJSONL(w io.Writer, st *balanceStatement) error {
+	enc := json.NewEncoder(w)
+	for _, row := range st.Rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(map[string]interface{}{"summary": st.Summary})
+}
+
+// writeStatementCSV writes the entries, a blank line and the summary
+// footer. A UTF-8 BOM lets spreadsheet applications detect the encoding.
+func writeStatementCSV(w io.Writer, st *balanceStatement) error {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "type", "amount", "balance_after", "running_balance", "mismatch", "description"})
+	for _, row := range st.Rows {
+		cw.Write([]string{
+			strconv.FormatUint(uint64(row.ID), 10),
+			row.CreatedAt.Format(time.RFC3339),
+			csvText(row.Type),
+			formatAmount(row.Amount),
+			formatAmount(row.BalanceAfter),
+			formatAmount(row.RunningBalance),
+			strconv.FormatBool(row.Mismatch),
+			csvText(row.Description),
+		})
+	}
+
+	sum := st.Summary
+	cw.Write(nil)
+	cw.Write([]string{"summary", "count", "credits", "debits", "net"})
+	for _, ts := range sum.ByType {
+		cw.Write([]string{csvText(ts.Type), strconv.Itoa(ts.Count), formatAmount(ts.Credits), formatAmount(ts.Debits), formatAmount(ts.Net)})
+	}
+	cw.Write([]string{"total", strconv.Itoa(sum.Count), formatAmount(sum.Credits), formatAmount(sum.Debits), formatAmount(round2(sum.Credits + sum.Debits))})
+	cw.Write([]string{"opening_balance", formatAmount(sum.OpeningBalance)})
+	cw.Write([]string{"closing_balance", formatAmount(sum.ClosingBalance)})
+	cw.Write([]string{"mismatches", strconv.Itoa(sum.Mismatches)})
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatAmount formats a money amount with two decimals
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// csvText guards free-form text against spreadsheet formula injection
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportFileName names an export file after its range and format
+func exportFileName(rng logRange, format string) string {
+	name := "balance-logs"
+	if !rng.From.IsZero() {
+		name += "_" + rng.From.Format(dateLayout)
+	}
+	if !rng.To.IsZero() {
+		name += "_to_" + rng.To.Format(dateLayout)
+	}
+	return name + "." + format
+}
+
+// parseExportFormat validates the export format, defaulting to CSV
+func parseExportFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return formatCSV, nil
+	case formatCSV, formatJSONL:
+		return format, nil
+	}
+	return "", newAPIError(http.StatusBadRequest, "format 必须是 csv 或 jsonl")
+}
+
+// handleJWTBalanceLogsExport exports every balance log in the range as a
+// statement with running totals and a summary footer
+func handleJWTBalanceLogsExport(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	q := r.URL.Query()
+	rng, err := parseLogRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	format, err := parseExportFormat(q.Get("format"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	logs, _, err := fetchAllBalanceLogs(rng)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	st := buildStatement(logs, rng)
+
+	// Walking every page may have used up the write timeout
+	writeTimeout := secondsOrDefault(currentConfig().WriteTimeout, defaultWriteTimeout)
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if format == formatJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(rng, format)))
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(st.Rows)))
+	writeStatement(w, st, format)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Balance rule defaults
+const (
+	defaultBalanceRuleInterval = 5 * 60  // Seconds between checks
+	defaultBalanceRuleCooldown = 60 * 60 // Seconds before a rule fires again while the balance stays low
+	defaultBalanceRuleLog      = "balance-rules.jsonl"
+	maxBalanceRuleLogEntries   = 200 // Entries returned by /api/balance-rules/log
+)
+
+// Rule actions
+const (
+	ruleAlert    = "alert"
+	ruleRecharge = "recharge"
+)
+
+// Outcomes recorded for a triggered rule
+const (
+	ruleAlerted = "alerted"
+	ruleCreated = "created"
+	ruleDryRun  = "dry_run"
+	ruleCapped  = "capped"
+	ruleFailed  = "failed"
+
+	rulePending = "pending" // Admitted recharge whose order is not created yet, never recorded
+)
+
+// eventBalanceRule is published for every triggered rule
+const eventBalanceRule = "balance.rule"
+
+// BalanceRule fires when the balance drops below Below. Alerts notify
+// the user; recharges create a recharge order of Amount.
+type BalanceRule struct {
+	Name          string  `json:"name"`
+	Below         float64 `json:"below"`
+	Action        string  `json:"action"`                   // alert or recharge
+	Amount        float64 `json:"amount,omitempty"`         // Recharge amount
+	PaymentMethod string  `json:"payment_method,omitempty"` // Recharge payment method
+	Cooldown      int     `json:"cooldown,omitempty"`       // Seconds, default 3600
+}
+
+// ruleTrigger is one audit log entry. It is also the payload of
+// balance.rule.
+type ruleTrigger struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Action  string    `json:"action"`
+	Below   float64   `json:"below"`
+	Balance float64   `json:"balance"`
+	Amount  float64   `json:"amount,omitempty"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+	OrderID uint      `json:"order_id,omitempty"`
+	OrderNo string    `json:"order_no,omitempty"`
+}
+
+// balanceRuleState tracks one rule between checks
+type balanceRuleState struct {
+	Triggered time.Time `json:"triggered"` // Last time the rule fired, zero when the balance recovered
+	Low       bool      `json:"low"`       // Balance below the threshold at the last check
+}
+
+// balanceWatcher evaluates the balance rules. mu guards the state but
+// is not held across upstream calls; a recharge reserves its amount in
+// spent before the order is created so concurrent checks respect the
+// daily cap. The spend of the current day is restored from the audit
+// log at startup.
+type balanceWatcher struct {
+	mu        sync.Mutex
+	states    map[string]*balanceRuleState
+	lastCheck time.Time
+	balance   float64
+	spentDay  string // Local date of spent
+	spent     float64
+	token     string // Exchanged from the API key, separate from the browser session
+}
+
+var balanceRules = &balanceWatcher{states: make(map[string]*balanceRuleState)}
+
+// validateBalanceRules fills in default names and rejects rules that
+// cannot be evaluated
+func validateBalanceRules(rules []BalanceRule) error {
+	seen := make(map[string]bool)
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" {
+			r.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("余额规则名称重复: %s", r.Name)
+		}
+		seen[r.Name] = true
+
+		switch {
+		case r.Below <= 0:
+			return fmt.Errorf("余额规则 %s: below 必须大于 0", r.Name)
+		case r.Action != ruleAlert && r.Action != ruleRecharge:
+			return fmt.Errorf("余额规则 %s: action 必须是 %s 或 %s", r.Name, ruleAlert, ruleRecharge)
+		case r.Action == ruleRecharge && r.Amount <= 0:
+			return fmt.Errorf("余额规则 %s: 充值规则需要大于 0 的 amount", r.Name)
+		case r.Action == ruleRecharge && r.PaymentMethod == "":
+			return fmt.Errorf("余额规则 %s: 充值规则需要 payment_method", r.Name)
+		case r.Cooldown < 0:
+			return fmt.Errorf("余额规则 %s: cooldown 不能为负数", r.Name)
+		}
+	}
+	return nil
+}
+
+// balanceRuleLogPath returns the audit log file
+func balanceRuleLogPath() string {
+	cfg := currentConfig()
+	if cfg.BalanceRuleLog == "" {
+		return defaultBalanceRuleLog
+	}
+	return cfg.BalanceRuleLog
+}
+
+// startBalanceRules checks the rules after startup and then every
+// balance_rule_interval until the server shuts down
+func startBalanceRules() {
+	cfg := currentConfig()
+	if len(cfg.BalanceRules) == 0 {
+		return
+	}
+	if err := balanceRules.restoreSpent(time.Now()); err != nil {
+		log.Printf("读取余额规则日志失败: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(secondsOrDefault(cfg.BalanceRuleInterval, defaultBalanceRuleInterval))
+		defer ticker.Stop()
+		for {
+			if _, err := balanceRules.check(time.Now()); err != nil {
+				log.Printf("检查余额规则失败: %v", err)
+			}
+			select {
+			case <-serverClosing:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// restoreSpent sums today's top-up orders from the audit log, so a
+// restart does not reset the daily cap
+func (b *balanceWatcher) restoreSpent(now time.Time) error {
+	entries, err := readRuleTriggers(0)
+	if err != nil {
+		return err
+	}
+
+	day := now.Format("2006-01-02")
+	spent := 0.0
+	for _, e := range entries {
+		if e.Outcome == ruleCreated && e.Time.Local().Format("2006-01-02") == day {
+			spent += e.Amount
+		}
+	}
+
+	b.mu.Lock()
+	b.spentDay, b.spent = day, round2(spent)
+	b.mu.Unlock()
+	return nil
+}
+
+// spentToday returns the top-up amount of the current day
+func (b *balanceWatcher) spentToday(now time.Time) float64 {
+	if day := now.Format("2006-01-02"); b.spentDay != day {
+		b.spentDay, b.spent = day, 0
+	}
+	return b.spent
+}
+
+// check fetches the balance and fires every rule whose threshold it is
+// below, unless the rule already fired within its cooldown
+func (b *balanceWatcher) check(now time.Time) ([]ruleTrigger, error) {
+	cfg := currentConfig()
+	balance, err := fetchBalance()
+	if err != nil {
+		return nil, err
+	}
+
+	// Decide which rules fire under the lock, then run them without it
+	b.mu.Lock()
+	if now.After(b.lastCheck) {
+		b.lastCheck, b.balance = now, balance.Balance
+	}
+	fired := []ruleTrigger{}
+	rules := []BalanceRule{}
+	for _, rule := range cfg.BalanceRules {
+		st, ok := b.states[rule.Name]
+		if !ok {
+			st = &balanceRuleState{}
+			b.states[rule.Name] = st
+		}
+		st.Low = balance.Balance < rule.Below
+		if !st.Low {
+			st.Triggered = time.Time{}
+			continue
+		}
+		cooldown := secondsOrDefault(rule.Cooldown, defaultBalanceRuleCooldown)
+		if !st.Triggered.IsZero() && now.Sub(st.Triggered) < cooldown {
+			continue
+		}
+		st.Triggered = now
+		fired = append(fired, b.admit(cfg, rule, balance.Balance, now))
+		rules = append(rules, rule)
+	}
+	b.mu.Unlock()
+
+	for i, t := range fired {
+		if t.Outcome == rulePending {
+			t = b.recharge(cfg, rules[i], t)
+		}
+		if err := appendRuleTrigger(t); err != nil {
+			log.Printf("写入余额规则日志失败: %v", err)
+		}
+		log.Printf("余额规则 %s 触发（余额 %s < %s）: %s %s", t.Rule, formatAmount(t.Balance), formatAmount(t.Below), t.Outcome, t.Reason)
+		events.publish(event{Type: eventBalanceRule, Data: t})
+		fired[i] = t
+	}
+	return fired, nil
+}
+
+// admit starts a rule's trigger with b.mu held. Alerts are complete;
+// recharges are checked against the daily cap and, outside dry-run,
+// reserve their amount and come back pending.
+func (b *balanceWatcher) admit(cfg *Config, rule BalanceRule, balance float64, now time.Time) ruleTrigger {
+	t := ruleTrigger{
+		Time:    now,
+		Rule:    rule.Name,
+		Action:  rule.Action,
+		Below:   rule.Below,
+		Balance: balance,
+		Outcome: ruleAlerted,
+	}
+	if rule.Action != ruleRecharge {
+		return t
+	}
+	t.Amount = rule.Amount
+
+	spent := b.spentToday(now)
+	switch {
+	case cfg.DailyTopUpCap <= 0:
+		t.Outcome, t.Reason = ruleCapped, "未设置每日充值上限（daily_top_up_cap），不会自动充值"
+		return t
+	case spent+rule.Amount > cfg.DailyTopUpCap:
+		t.Outcome = ruleCapped
+		t.Reason = fmt.Sprintf("今日已充值 %s 元，再充值 %s 元将超过每日上限 %s 元",
+			formatAmount(spent), formatAmount(rule.Amount), formatAmount(cfg.DailyTopUpCap))
+		return t
+	}
+	if !cfg.BalanceRulesDryRun {
+		b.spent = round2(spent + rule.Amount)
+	}
+	t.Outcome = rulePending
+	return t
+}
+
+// recharge creates the top-up order of an admitted rule through
+// /api/payment/create with a key derived from the rule and trigger time.
+// The reserved amount is released unless the order is created.
+func (b *balanceWatcher) recharge(cfg *Config, rule BalanceRule, t ruleTrigger) ruleTrigger {
+	if !cfg.BalanceRulesDryRun {
+		defer func() {
+			if t.Outcome != ruleCreated {
+				b.release(t.Time, rule.Amount)
+			}
+		}()
+	}
+
+	req := RechargeRequest{Amount: rule.Amount, PaymentMethod: rule.PaymentMethod}
+	settings, err := liveRechargeSettings.get()
+	if err != nil {
+		t.Outcome, t.Reason = ruleFailed, fmt.Sprintf("获取充值设置失败: %v", err)
+		return t
+	}
+	if err := req.validate(settings); err != nil {
+		t.Outcome, t.Reason = ruleFailed, err.Error()
+		return t
+	}
+	req.ProductType = productRecharge
+
+	if cfg.BalanceRulesDryRun {
+		t.Outcome, t.Reason = ruleDryRun, "演练模式，未创建订单"
+		return t
+	}
+	token, err := b.ensureToken(false)
+	if err != nil {
+		t.Outcome, t.Reason = ruleFailed, fmt.Sprintf("获取Token失败: %v", err)
+		return t
+	}
+
+	key := fmt.Sprintf("balance-rule-%d-%s-%d", cfg.UserID, rule.Name, t.Time.Unix())
+	header := http.Header{idempotencyKeyHeader: {key}}
+	resp, err := makeTokenRequest(token, "POST", "/api/payment/create", req, header)
+	if errorStatus(err) == http.StatusUnauthorized {
+		// The token expired; the same key makes the retry safe
+		if token, err = b.ensureToken(true); err == nil {
+			resp, err = makeTokenRequest(token, "POST", "/api/payment/create", req, header)
+		}
+	}
+	summary := map[string]interface{}{"rule": rule.Name, "amount": rule.Amount, "payment_method": rule.PaymentMethod, "idempotency_key": key}
+	session := sessionFingerprint(token)
+	if err != nil {
+		recordAudit("", session, auditRuleRecharge, summary, errorStatus(err), false, err.Error())
+		t.Outcome, t.Reason = ruleFailed, err.Error()
+		return t
+	}
+	recordAudit("", session, auditRuleRecharge, summary, http.StatusOK, true, resp.Message)
+
+	t.Outcome = ruleCreated
+	if order, ok := createdOrder(resp.Data, productRecharge); ok {
+		t.OrderID, t.OrderNo = order.ID, order.OrderNo
+		tracker.track(token, order)
+	}
+	return t
+}
+
+// release returns a reserved amount when its order was not created
+func (b *balanceWatcher) release(now time.Time, amount float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.spentDay == now.Format("2006-01-02") {
+		b.spent = round2(max(b.spent-amount, 0))
+	}
+}
+
+// ensureToken returns the watcher's token, exchanging the API key when
+// there is none or renew is set. Rules can create orders without a
+// browser session, and never replace the session's token.
+func (b *balanceWatcher) ensureToken(renew bool) (string, error) {
+	b.mu.Lock()
+	token := b.token
+	b.mu.Unlock()
+	if token != "" && !renew {
+		return token, nil
+	}
+
+	resp, err := exchangeForToken()
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	b.token = resp.AccessToken
+	b.mu.Unlock()
+	return resp.AccessToken, nil
+}
+
+// appendRuleTrigger appends an entry to the audit log
+func appendRuleTrigger(t ruleTrigger) error {
+	f, err := os.OpenFile(balanceRuleLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(t); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readRuleTriggers reads the audit log, keeping the last limit entries
+// (all when limit is 0). A missing file is an empty log.
+func readRuleTriggers(limit int) ([]ruleTrigger, error) {
+	f, err := os.Open(balanceRuleLogPath())
+	if os.IsNotExist(err) {
+		return []ruleTrigger{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []ruleTrigger{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var t ruleTrigger
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			continue // Skip a line cut short by a crash
+		}
+		entries = append(entries, t)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// handleBalanceRules returns the rules, their state and today's spend
+func handleBalanceRules(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	now := time.Now()
+	b := balanceRules
+	b.mu.Lock()
+	states := make(map[string]balanceRuleState, len(b.states))
+	for name, st := range b.states {
+		states[name] = *st
+	}
+	data := map[string]interface{}{
+		"rules":          cfg.BalanceRules,
+		"states":         states,
+		"dry_run":        cfg.BalanceRulesDryRun,
+		"daily_cap":      cfg.DailyTopUpCap,
+		"spent_today":    b.spentToday(now),
+		"interval":       int(secondsOrDefault(cfg.BalanceRuleInterval, defaultBalanceRuleInterval).Seconds()),
+		"last_check":     nil,
+		"last_balance":   nil,
+		"enabled":        len(cfg.BalanceRules) > 0,
+		"audit_log_file": balanceRuleLogPath(),
+	}
+	if !b.lastCheck.IsZero() {
+		data["last_check"], data["last_balance"] = b.lastCheck, b.balance
+	}
+	b.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    data,
+	})
+}
+
+// handleBalanceRulesCheck evaluates the rules now
+func handleBalanceRulesCheck(w http.ResponseWriter, r *http.Request) {
+	if len(currentConfig().BalanceRules) == 0 {
+		writeError(w, newAPIError(http.StatusConflict, "未配置余额规则"))
+		return
+	}
+	triggered, err := balanceRules.check(time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    triggered,
+	})
+}
+
+// handleBalanceRulesLog returns the newest audit log entries, newest
+// first
+func handleBalanceRulesLog(w http.ResponseWriter, r *http.Request) {
+	limit := maxBalanceRuleLogEntries
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v < limit {
+		limit = v
+	}
+	entries, err := readRuleTriggers(limit)
+	if err != nil {
+		writeError(w, newAPIError(http.StatusInternalServerError, "读取余额规则日志失败: %v", err))
+		return
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    entries,
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBalanceWatcherAdmit(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.Local)
+	alert := BalanceRule{Name: "low", Below: 10, Action: ruleAlert}
+	topUp := BalanceRule{Name: "top-up", Below: 10, Action: ruleRecharge, Amount: 30, PaymentMethod: "alipay"}
+
+	tests := []struct {
+		name      string
+		rule      BalanceRule
+		cap       float64
+		dryRun    bool
+		spent     float64
+		want      string
+		wantSpent float64
+	}{
+		{"alert ignores the cap", alert, 0, false, 0, ruleAlerted, 0},
+		{"no cap configured", topUp, 0, false, 0, ruleCapped, 0},
+		{"within cap reserves", topUp, 50, false, 10, rulePending, 40},
+		{"exactly at cap", topUp, 50, false, 20, rulePending, 50},
+		{"over cap", topUp, 50, false, 30, ruleCapped, 30},
+		{"dry run does not reserve", topUp, 50, true, 10, rulePending, 10},
+		{"dry run still capped", topUp, 50, true, 30, ruleCapped, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &balanceWatcher{states: make(map[string]*balanceRuleState)}
+			b.spentDay, b.spent = now.Format("2006-01-02"), tt.spent
+			cfg := &Config{DailyTopUpCap: tt.cap, BalanceRulesDryRun: tt.dryRun}
+
+			got := b.admit(cfg, tt.rule, 5, now)
+			if got.Outcome != tt.want {
+				t.Errorf("outcome = %q (%s), want %q", got.Outcome, got.Reason, tt.want)
+			}
+			if got.Outcome == ruleCapped && got.Reason == "" {
+				t.Error("capped trigger has no reason")
+			}
+			if b.spent != tt.wantSpent {
+				t.Errorf("spent = %v, want %v", b.spent, tt.wantSpent)
+			}
+		})
+	}
+}
+
+func TestBalanceWatcherSpentToday(t *testing.T) {
+	day := time.Date(2026, 10, 18, 23, 0, 0, 0, time.Local)
+	b := &balanceWatcher{states: make(map[string]*balanceRuleState)}
+	cfg := &Config{DailyTopUpCap: 50}
+	rule := BalanceRule{Name: "top-up", Below: 10, Action: ruleRecharge, Amount: 30}
+
+	if got := b.admit(cfg, rule, 5, day); got.Outcome != rulePending {
+		t.Fatalf("first admit = %q, want %q", got.Outcome, rulePending)
+	}
+	if got := b.admit(cfg, rule, 5, day); got.Outcome != ruleCapped {
+		t.Fatalf("second admit = %q, want %q", got.Outcome, ruleCapped)
+	}
+
+	// Releasing a failed order frees its reservation
+	b.release(day, rule.Amount)
+	if got := b.spentToday(day); got != 0 {
+		t.Errorf("spent after release = %v, want 0", got)
+	}
+	b.release(day, rule.Amount)
+	if got := b.spentToday(day); got != 0 {
+		t.Errorf("spent after a second release = %v, want 0", got)
+	}
+
+	// A reservation from yesterday is not released into today
+	b.admit(cfg, rule, 5, day)
+	next := day.Add(2 * time.Hour)
+	if got := b.spentToday(next); got != 0 {
+		t.Errorf("spent on the next day = %v, want 0", got)
+	}
+	b.release(day, rule.Amount)
+	if got := b.admit(cfg, rule, 5, next); got.Outcome != rulePending || b.spent != 30 {
+		t.Errorf("admit on the next day = %q with spent %v, want %q with 30", got.Outcome, b.spent, rulePending)
+	}
+}
+
+// balanceUpstream serves the endpoints a balance check calls and counts
+// the orders it creates
+func balanceUpstream(t *testing.T, balance float64) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var orders atomic.Int32
+	reply := func(w http.ResponseWriter, data interface{}) {
+		raw, _ := json.Marshal(data)
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: raw})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/user-api/balance", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, UserBalance{Balance: balance})
+	})
+	mux.HandleFunc("/api/user-api/token", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, TokenResponse{AccessToken: "rule-token"})
+	})
+	mux.HandleFunc("/api/recharge-settings", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, RechargeSettings{MinAmount: 1, PaymentMethods: []string{"alipay"}})
+	})
+	mux.HandleFunc("/api/payment/create", func(w http.ResponseWriter, r *http.Request) {
+		orders.Add(1)
+		reply(w, map[string]interface{}{})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &orders
+}
+
+// useBalanceConfig publishes a config for a balance check against srv
+// and restores the previous one afterwards
+func useBalanceConfig(t *testing.T, srv *httptest.Server, dryRun bool) {
+	t.Helper()
+	prev := currentConfig()
+	cfg := *prev
+	cfg.ServerURL, cfg.UserAPIKey, cfg.UserID = srv.URL, "key", 1
+	cfg.BalanceRules = []BalanceRule{
+		{Name: "low", Below: 10, Action: ruleAlert},
+		{Name: "top-up", Below: 10, Action: ruleRecharge, Amount: 30, PaymentMethod: "alipay"},
+	}
+	cfg.DailyTopUpCap = 50
+	cfg.BalanceRulesDryRun = dryRun
+	cfg.BalanceRuleLog = filepath.Join(t.TempDir(), "rules.jsonl")
+	configPtr.Store(&cfg)
+
+	liveRechargeSettings.fetched = time.Time{}
+	t.Cleanup(func() {
+		configPtr.Store(prev)
+		liveRechargeSettings.fetched = time.Time{}
+	})
+}
+
+// outcomes maps each trigger's rule to its outcome
+func outcomes(triggers []ruleTrigger) map[string]string {
+	got := make(map[string]string, len(triggers))
+	for _, tr := range triggers {
+		got[tr.Rule] = tr.Outcome
+	}
+	return got
+}
+
+func TestBalanceWatcherCheck(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.Local)
+
+	t.Run("dry run creates no order", func(t *testing.T) {
+		srv, orders := balanceUpstream(t, 5)
+		useBalanceConfig(t, srv, true)
+		b := &balanceWatcher{states: make(map[string]*balanceRuleState)}
+
+		fired, err := b.check(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"low": ruleAlerted, "top-up": ruleDryRun}
+		if got := outcomes(fired); !maps.Equal(got, want) {
+			t.Errorf("outcomes = %v, want %v", got, want)
+		}
+		if n := orders.Load(); n != 0 {
+			t.Errorf("created %d orders in dry run", n)
+		}
+		if got := b.spentToday(now); got != 0 {
+			t.Errorf("spent = %v in dry run, want 0", got)
+		}
+		logged, err := readRuleTriggers(0)
+		if err != nil || len(logged) != 2 {
+			t.Errorf("audit log has %d entries (%v), want 2", len(logged), err)
+		}
+	})
+
+	t.Run("cooldown and daily cap", func(t *testing.T) {
+		srv, orders := balanceUpstream(t, 5)
+		useBalanceConfig(t, srv, false)
+		b := &balanceWatcher{states: make(map[string]*balanceRuleState)}
+
+		steps := []struct {
+			at     time.Time
+			want   map[string]string
+			orders int32
+			spent  float64
+		}{
+			{now, map[string]string{"low": ruleAlerted, "top-up": ruleCreated}, 1, 30},
+			{now.Add(30 * time.Minute), map[string]string{}, 1, 30},
+			{now.Add(2 * time.Hour), map[string]string{"low": ruleAlerted, "top-up": ruleCapped}, 1, 30},
+		}
+		for i, s := range steps {
+			fired, err := b.check(s.at)
+			if err != nil {
+				t.Fatalf("check %d: %v", i, err)
+			}
+			if got := outcomes(fired); !maps.Equal(got, s.want) {
+				t.Errorf("check %d: outcomes = %v, want %v", i, got, s.want)
+			}
+			if n := orders.Load(); n != s.orders {
+				t.Errorf("check %d: %d orders created, want %d", i, n, s.orders)
+			}
+			if got := b.spentToday(s.at); got != s.spent {
+				t.Errorf("check %d: spent = %v, want %v", i, got, s.spent)
+			}
+		}
+	})
+
+	t.Run("recovered balance resets the cooldown", func(t *testing.T) {
+		low, _ := balanceUpstream(t, 5)
+		high, _ := balanceUpstream(t, 100)
+		b := &balanceWatcher{states: make(map[string]*balanceRuleState)}
+
+		useBalanceConfig(t, low, true)
+		if fired, err := b.check(now); err != nil || len(fired) != 2 {
+			t.Fatalf("first check fired %d (%v), want 2", len(fired), err)
+		}
+		useBalanceConfig(t, high, true)
+		if fired, err := b.check(now.Add(time.Minute)); err != nil || len(fired) != 0 {
+			t.Fatalf("recovered check fired %d (%v), want 0", len(fired), err)
+		}
+		useBalanceConfig(t, low, true)
+		if fired, err := b.check(now.Add(2 * time.Minute)); err != nil || len(fired) != 2 {
+			t.Errorf("check after recovery fired %d (%v), want 2", len(fired), err)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// commands are the command-line subcommands, run as
+// `demo_user_api <command> [flags]`. They use the API key from the
+// configuration to obtain a JWT token.
+var commands = map[string]func(args []string) error{
+	"export-balance-logs": cmdExportBalanceLogs,
+	"reconcile-balance":   cmdReconcileBalance,
+	"sign-webhook":        cmdSignWebhook,
+}
+
+// runCommand runs a subcommand and returns the process exit code
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n可用命令:\n", args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+		return 2
+	}
+
+	if err := cmd(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// commandLogin exchanges the configured API key for a JWT token
+func commandLogin() error {
+	if currentConfig().ServerURL == "" || currentConfig().UserAPIKey == "" || currentConfig().UserID == 0 {
+		return errNotConfigured
+	}
+	token, err := exchangeForToken()
+	if err != nil {
+		return err
+	}
+	setCachedToken(token.AccessToken)
+	return nil
+}
+
+// createOutput opens the output file, or stdout for "" and "-"
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+// cmdExportBalanceLogs writes a balance statement like
+// /api/jwt/balance-logs/export
+func cmdExportBalanceLogs(args []string) error {
+	fs := flag.NewFlagSet("export-balance-logs", flag.ContinueOnError)
+	from := fs.String("from", "", "开始日期 (YYYY-MM-DD)")
+	to := fs.String("to", "", "结束日期 (YYYY-MM-DD，包含当天)")
+	format := fs.String("format", formatCSV, "输出格式: csv 或 jsonl")
+	output := fs.String("o", "", "输出文件（默认标准输出）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rng, err := parseLogRange(*from, *to)
+	if err != nil {
+		return err
+	}
+	if *format, err = parseExportFormat(*format); err != nil {
+		return err
+	}
+
+	if err := commandLogin(); err != nil {
+		return err
+	}
+	logs, _, err := fetchAllBalanceLogs(rng)
+	if err != nil {
+		return err
+	}
+	st := buildStatement(logs, rng)
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeStatement(out, st, *format); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "已导出 %d 条余额记录（收入 %s，支出 %s，核对不一致 %d 条）\n",
+		st.Summary.Count, formatAmount(st.Summary.Credits), formatAmount(st.Summary.Debits), st.Summary.Mismatches)
+	return nil
+}
+
+// cmdReconcileBalance writes a reconciliation report like
+// /api/jwt/balance-logs/reconcile. It fails when issues are found so
+// scripts can alert on the exit code.
+func cmdReconcileBalance(args []string) error {
+	fs := flag.NewFlagSet("reconcile-balance", flag.ContinueOnError)
+	format := fs.String("format", "text", "输出格式: text 或 json")
+	output := fs.String("o", "", "输出文件（默认标准输出）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("format 必须是 text 或 json")
+	}
+
+	if err := commandLogin(); err != nil {
+		return err
+	}
+	report, err := reconcileBalance()
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.writeText(out)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if !report.Consistent {
+		return fmt.Errorf("对账发现 %d 个问题", len(report.Issues))
+	}
+	return nil
+}
+
+// cmdSignWebhook signs a payment notification with the webhook secret,
+// printing the headers and body or posting them to a running demo with
+// -send, to test /webhooks/payment without the login service
+func cmdSignWebhook(args []string) error {
+	fs := flag.NewFlagSet("sign-webhook", flag.ContinueOnError)
+	secret := fs.String("secret", currentConfig().WebhookSecret, "签名密钥（默认使用配置中的 webhook_secret）")
+	orderID := fs.Uint("order", 0, "订单ID")
+	orderNo := fs.String("order-no", "", "订单号")
+	status := fs.String("status", orderPaid, "订单状态")
+	amount := fs.Float64("amount", 0, "订单金额")
+	productType := fs.String("product", "", "商品类型: vip 或 recharge")
+	send := fs.String("send", "", "直接发送到该地址，例如 http://127.0.0.1:8183/webhooks/payment")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *secret == "" {
+		return fmt.Errorf("未配置 webhook_secret，请使用 -secret 指定")
+	}
+	if *orderID == 0 {
+		return fmt.Errorf("请使用 -order 指定订单ID")
+	}
+
+	n := paymentNotification{
+		Event:       "payment.status",
+		OrderID:     *orderID,
+		OrderNo:     *orderNo,
+		ProductType: *productType,
+		Amount:      *amount,
+		Status:      *status,
+	}
+	if isPaidStatus(n.Status) {
+		now := time.Now().UTC()
+		n.PaidAt = &now
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	signature := signWebhook(*secret, timestamp, body)
+
+	if *send == "" {
+		fmt.Printf("%s: %d\n%s: %s\n\n%s\n", webhookTimestampHeader, timestamp, webhookSignatureHeader, signature, body)
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", *send, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signature)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s\n%s", resp.Status, reply)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("回调被拒绝")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e54385991/Common-LoginService/demo_user_api/analytics"
+)
+
+// handleDashboard renders the spending analytics page
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	data := PageData{
+		Config:    *currentConfig(),
+		HasToken:  getCachedToken() != "",
+		CSRFToken: ensureCSRFToken(w, r),
+	}
+
+	renderTemplate(w, "dashboard.html", data)
+}
+
+// handleJWTAnalytics aggregates balance logs and payment orders for the
+// dashboard. Query: period=day|week|month, from/to (YYYY-MM-DD) and
+// window, the number of days used for the burn rate.
+func handleJWTAnalytics(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	q := r.URL.Query()
+	period, ok := analytics.ParsePeriod(q.Get("period"))
+	if !ok {
+		writeError(w, newAPIError(http.StatusBadRequest, "period 必须是 day、week 或 month"))
+		return
+	}
+	rng, err := parseLogRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	window := analytics.DefaultBurnWindow
+	if v := q.Get("window"); v != "" {
+		if window, err = strconv.Atoi(v); err != nil || window < 1 || window > 365 {
+			writeError(w, newAPIError(http.StatusBadRequest, "window 必须在 1 到 365 之间"))
+			return
+		}
+	}
+
+	now := time.Now()
+	balance, err := fetchJWTBalance()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// The burn rate needs the most recent window whatever the range, so
+	// fetch from the earlier of the two up to now
+	fetchRange := logRange{From: rng.From}
+	if burnStart := now.AddDate(0, 0, -window); !rng.From.IsZero() && burnStart.Before(rng.From) {
+		fetchRange.From = burnStart
+	}
+	logs, _, err := fetchAllBalanceLogs(fetchRange)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	orders, err := fetchAllPaymentOrders()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entries := make([]analytics.Entry, 0, len(logs))
+	for _, entry := range logs {
+		entries = append(entries, analytics.Entry{Time: entry.CreatedAt, Type: entry.Type, Amount: entry.Amount})
+	}
+	paid := make([]analytics.Order, 0, len(orders))
+	for _, order := range orders {
+		paid = append(paid, analytics.Order{
+			Time:   order.CreatedAt,
+			Type:   order.ProductType,
+			Amount: order.Amount,
+			Paid:   isPaidStatus(order.Status),
+		})
+	}
+
+	report := analytics.Build(entries, paid, analytics.Options{
+		Period:     period,
+		From:       rng.From,
+		To:         rng.To,
+		Now:        now,
+		Balance:    balance.Balance,
+		BurnWindow: window,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    report,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// apiError is an error carrying the HTTP status returned to the browser
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError creates an apiError with a formatted message
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// fieldErrors reports invalid request fields, keyed by JSON field name.
+// It is returned as 400 with the messages in "fields".
+type fieldErrors map[string]string
+
+func (e fieldErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+": "+e[name])
+	}
+	return "请求参数无效: " + strings.Join(parts, "; ")
+}
+
+// Common handler errors
+var (
+	errNoToken       = &apiError{Status: http.StatusUnauthorized, Message: "请先获取Token"}
+	errInvalidBody   = &apiError{Status: http.StatusBadRequest, Message: "Invalid request body"}
+	errNoServerURL   = &apiError{Status: http.StatusServiceUnavailable, Message: "服务器地址未配置"}
+	errNoAPIKey      = &apiError{Status: http.StatusServiceUnavailable, Message: "API密钥未配置"}
+	errNoUserID      = &apiError{Status: http.StatusServiceUnavailable, Message: "用户ID未配置"}
+	errTokenMissing  = &apiError{Status: http.StatusUnauthorized, Message: "JWT Token未获取"}
+	errNotConfigured = &apiError{Status: http.StatusServiceUnavailable, Message: "请先配置服务器地址"}
+)
+
+// upstreamStatus maps the login service status of a failed call to the
+// status returned to the browser
+func upstreamStatus(code int) int {
+	switch {
+	case code == http.StatusGatewayTimeout:
+		return http.StatusGatewayTimeout
+	case code >= 500:
+		return http.StatusBadGateway
+	case code >= 400:
+		return code
+	default:
+		// The upstream answered success:false with a 2xx/3xx status
+		return http.StatusBadRequest
+	}
+}
+
+// parseFailureStatus returns the status for an unparseable upstream body
+func parseFailureStatus(code int) int {
+	if code >= 400 {
+		return upstreamStatus(code)
+	}
+	return http.StatusBadGateway
+}
+
+// resultStatus returns the status for a passthrough upstream response
+func resultStatus(resp *APIResponse) int {
+	if resp.Success {
+		return http.StatusOK
+	}
+	return upstreamStatus(resp.StatusCode)
+}
+
+// transportError wraps a failed upstream round trip, using 504 for
+// timeouts and 502 for everything else
+func transportError(err error) *apiError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return newAPIError(http.StatusGatewayTimeout, "请求超时: %v", err)
+	}
+	return newAPIError(http.StatusBadGateway, "请求失败: %v", err)
+}
+
+// errorStatus returns the HTTP status for an error, defaulting to 502
+// since most handler errors come from the upstream call
+func errorStatus(err error) int {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	var fields fieldErrors
+	if errors.As(err, &fields) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// upstreamUnavailable reports whether err means the login service could
+// not be reached or failed, rather than rejecting the request
+func upstreamUnavailable(err error) bool {
+	status := errorStatus(err)
+	return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
+
+// writeJSON writes a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(payload)
+}
+
+// writeError writes the {success, error} envelope with the error's status
+func writeError(w http.ResponseWriter, err error) {
+	payload := map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	}
+	var fields fieldErrors
+	if errors.As(err, &fields) {
+		payload["fields"] = fields
+	}
+	writeJSON(w, errorStatus(err), payload)
+}
+
+// jsonErrorWriter replaces the plain-text 404/405 bodies written by
+// ServeMux with the JSON envelope used by the UI
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if (status == http.StatusNotFound || status == http.StatusMethodNotAllowed) &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.replaced = true
+		writeJSON(w.ResponseWriter, status, map[string]interface{}{
+			"success": false,
+			"error":   http.StatusText(status),
+		})
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *jsonErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withJSONErrors applies jsonErrorWriter to API routes
+func withJSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w = &jsonErrorWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Account poller intervals. The interval resets to the minimum after a
+// change and grows by half after each quiet or failed poll.
+const (
+	minPollInterval   = 5 * time.Second
+	maxPollInterval   = 60 * time.Second
+	sseHeartbeat      = 25 * time.Second
+	subscriberBacklog = 16
+)
+
+// Event types pushed to subscribers
+const (
+	eventMessageNew     = "message.new"
+	eventUnreadChanged  = "unread.changed"
+	eventBalanceChanged = "balance.changed"
+)
+
+// event is an account event delivered to subscribers
+type event struct {
+	Type string
+	Data interface{}
+}
+
+// unreadChange is the payload of unread.changed
+type unreadChange struct {
+	UnreadCount int64 `json:"unread_count"`
+	Previous    int64 `json:"previous"`
+	Initial     bool  `json:"initial,omitempty"` // Baseline value, not a change
+}
+
+// balanceChange is the payload of balance.changed
+type balanceChange struct {
+	Balance  float64 `json:"balance"`
+	Previous float64 `json:"previous"`
+	Delta    float64 `json:"delta"`
+	VIPLevel int     `json:"vip_level"`
+	Initial  bool    `json:"initial,omitempty"` // Baseline value, not a change
+}
+
+// eventHub fans account events out to subscribers and runs the account
+// poller for the cached login session while anyone is subscribed
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan event]struct{}
+	stop        chan struct{}
+	wake        chan struct{} // Requests an immediate poll
+
+	// Latest unread/balance state, replayed to new subscribers
+	unread  *unreadChange
+	balance *balanceChange
+}
+
+var events = &eventHub{
+	subscribers: make(map[chan event]struct{}),
+	wake:        make(chan struct{}, 1),
+}
+
+// subscribe registers a subscriber, starting the poller if needed
+func (h *eventHub) subscribe() chan event {
+	ch := make(chan event, subscriberBacklog)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subscribers[ch] = struct{}{}
+	if h.unread != nil {
+		replay := *h.unread
+		replay.Initial = true
+		ch <- event{Type: eventUnreadChanged, Data: replay}
+	}
+	if h.balance != nil {
+		replay := *h.balance
+		replay.Initial = true
+		ch <- event{Type: eventBalanceChanged, Data: replay}
+	}
+
+	if h.stop == nil {
+		h.stop = make(chan struct{})
+		go h.poll(h.stop)
+	}
+	return ch
+}
+
+// unsubscribe removes a subscriber, stopping the poller after the last one
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, ch)
+	if len(h.subscribers) == 0 && h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+		h.unread, h.balance = nil, nil
+	}
+}
+
+// publish delivers an event to every subscriber. Subscribers that are
+// not keeping up miss the event rather than blocking the poller.
+func (h *eventHub) publish(ev event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch data := ev.Data.(type) {
+	case unreadChange:
+		h.unread = &data
+	case balanceChange:
+		h.balance = &data
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// refresh asks a running poller to check the account now
+func (h *eventHub) refresh() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// accountSnapshot is the last observed state of the polled session
+type accountSnapshot struct {
+	token         string
+	valid         bool
+	unread        int64
+	balance       float64
+	vipLevel      int
+	lastMessageID uint
+}
+
+// poll watches unread count and balance until stop is closed
+func (h *eventHub) poll(stop chan struct{}) {
+	var snap accountSnapshot
+	interval := minPollInterval
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		case <-h.wake:
+			timer.Stop()
+		}
+
+		changed, err := h.pollOnce(&snap)
+		switch {
+		case err != nil:
+			log.Printf("账户轮询失败: %v", err)
+			interval = min(interval*3/2, maxPollInterval)
+		case changed:
+			interval = minPollInterval
+		default:
+			interval = min(interval*3/2, maxPollInterval)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// pollOnce compares the current account state with the snapshot and
+// publishes the differences. The first poll of a session only records
+// the baseline.
+func (h *eventHub) pollOnce(snap *accountSnapshot) (bool, error) {
+	token := getCachedToken()
+	if token == "" {
+		*snap = accountSnapshot{}
+		return false, nil
+	}
+	if token != snap.token {
+		*snap = accountSnapshot{token: token}
+	}
+
+	unread, err := fetchUnreadCount()
+	if err != nil {
+		return false, err
+	}
+	balance, err := fetchJWTBalance()
+	if err != nil {
+		return false, err
+	}
+
+	if !snap.valid {
+		latest, err := fetchLatestMessages(1)
+		if err != nil {
+			return false, err
+		}
+		for _, msg := range latest {
+			snap.lastMessageID = max(snap.lastMessageID, msg.ID)
+		}
+		snap.valid = true
+		snap.unread = unread.UnreadCount
+		snap.balance = balance.Balance
+		snap.vipLevel = balance.VIPLevel
+		h.publish(event{Type: eventUnreadChanged, Data: unreadChange{UnreadCount: unread.UnreadCount, Previous: unread.UnreadCount, Initial: true}})
+		h.publish(event{Type: eventBalanceChanged, Data: balanceChange{Balance: balance.Balance, Previous: balance.Balance, VIPLevel: balance.VIPLevel, Initial: true}})
+		return false, nil
+	}
+
+	changed := false
+
+	if unread.UnreadCount != snap.unread {
+		changed = true
+		if unread.UnreadCount > snap.unread {
+			latest, err := fetchLatestMessages(int(unread.UnreadCount - snap.unread))
+			if err != nil {
+				return false, err
+			}
+			// Publish oldest first; the list is newest first
+			for i := len(latest) - 1; i >= 0; i-- {
+				if msg := latest[i]; msg.ID > snap.lastMessageID {
+					h.publish(event{Type: eventMessageNew, Data: msg})
+				}
+			}
+			for _, msg := range latest {
+				snap.lastMessageID = max(snap.lastMessageID, msg.ID)
+			}
+		}
+		h.publish(event{Type: eventUnreadChanged, Data: unreadChange{UnreadCount: unread.UnreadCount, Previous: snap.unread}})
+		snap.unread = unread.UnreadCount
+	}
+
+	// A VIP purchase can change the level without touching the balance
+	if balance.Balance != snap.balance || balance.VIPLevel != snap.vipLevel {
+		changed = true
+		h.publish(event{Type: eventBalanceChanged, Data: balanceChange{
+			Balance:  balance.Balance,
+			Previous: snap.balance,
+			Delta:    balance.Balance - snap.balance,
+			VIPLevel: balance.VIPLevel,
+		}})
+		snap.balance = balance.Balance
+		snap.vipLevel = balance.VIPLevel
+	}
+
+	return changed, nil
+}
+
+// fetchUnreadCount fetches the unread message count using JWT token
+func fetchUnreadCount() (*UnreadCountResponse, error) {
+	resp, err := makeJWTRequest("GET", "/api/messages/unread-count", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var unread UnreadCountResponse
+	if err := json.Unmarshal(resp.Data, &unread); err != nil {
+		return nil, fmt.Errorf("解析未读数量失败: %v", err)
+	}
+
+	return &unread, nil
+}
+
+// fetchJWTBalance fetches the user balance using JWT token
+func fetchJWTBalance() (*UserBalance, error) {
+	return fetchTokenBalance(getCachedToken())
+}
+
+// fetchTokenBalance fetches the balance and VIP state with the given token
+func fetchTokenBalance(token string) (*UserBalance, error) {
+	resp, err := makeTokenRequest(token, "GET", "/api/auth/balance", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var balance UserBalance
+	if err := json.Unmarshal(resp.Data, &balance); err != nil {
+		return nil, fmt.Errorf("解析余额信息失败: %v", err)
+	}
+
+	return &balance, nil
+}
+
+// fetchLatestMessages fetches up to n of the newest messages
+func fetchLatestMessages(n int) ([]Message, error) {
+	n = max(1, min(n, maxPageSize))
+	q := url.Values{}
+	q.Set("page", "1")
+	q.Set("page_size", strconv.Itoa(n))
+
+	resp, err := makeJWTRequest("GET", "/api/messages?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var page MessagesResponse
+	if err := json.Unmarshal(resp.Data, &page); err != nil {
+		return nil, fmt.Errorf("解析消息列表失败: %v", err)
+	}
+
+	return page.Messages, nil
+}
+
+// handleJWTEvents streams account events as Server-Sent Events
+func handleJWTEvents(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server write timeout
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	rc.Flush()
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-serverClosing:
+			return
+		case ev := <-ch:
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idempotency headers. Idempotency-Key is required from the client, sent
+// upstream and echoed in the response.
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen      = 255
+)
+
+// defaultIdempotencyWindow is how long a key is remembered, in seconds
+const defaultIdempotencyWindow = 24 * 60 * 60
+
+// idempotentResponse is the recorded outcome of the first request with
+// a key. done is closed once status and body are set.
+type idempotentResponse struct {
+	fingerprint string
+	done        chan struct{}
+	status      int
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache maps keys, scoped to the route and login session, to
+// the response of the first request that used them
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var idempotency = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+
+// idempotencyWindow returns the configured key lifetime
+func idempotencyWindow() time.Duration {
+	return secondsOrDefault(currentConfig().IdempotencyWindow, defaultIdempotencyWindow)
+}
+
+// validIdempotencyKey checks that a client key is printable ASCII of a
+// reasonable length
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// begin returns the entry for a key, creating it when the key is new or
+// expired. owner is true when the caller must perform the request.
+func (c *idempotencyCache) begin(scope, fingerprint string, now time.Time) (entry *idempotentResponse, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if e, ok := c.entries[scope]; ok {
+		return e, false
+	}
+	e := &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[scope] = e
+	return e, true
+}
+
+// complete records the response of the owning request. Only successful
+// responses are kept for the window; failures let the client retry
+// with the same key, while requests already waiting still see them.
+func (c *idempotencyCache) complete(scope string, e *idempotentResponse, status int, body []byte, now time.Time) {
+	c.mu.Lock()
+	e.status = status
+	e.body = body
+	e.expires = now.Add(idempotencyWindow())
+	if status < 200 || status >= 300 {
+		delete(c.entries, scope)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// recordingWriter copies the response written by a handler
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// serveIdempotent runs next once per Idempotency-Key. A retry with the
+// same key and body gets the recorded response, waiting if the first
+// request is still in flight; the same key with a different body is
+// rejected. Requests without a key are rejected too, since a key made
+// up here would differ on every retry.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		writeError(w, newAPIError(http.StatusBadRequest, "缺少 %s Header，重试时请使用同一个 Key", idempotencyKeyHeader))
+		return
+	}
+	if !validIdempotencyKey(key) {
+		writeError(w, newAPIError(http.StatusBadRequest, "%s 必须是 1-%d 个可见 ASCII 字符", idempotencyKeyHeader, maxIdempotencyKeyLen))
+		return
+	}
+	w.Header().Set(idempotencyKeyHeader, key)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBufferedBody))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, newAPIError(http.StatusRequestEntityTooLarge, "请求体过大"))
+		return
+	case err != nil:
+		writeError(w, errInvalidBody)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	scope := r.URL.Path + "\x00" + getCachedToken() + "\x00" + key
+	entry, owner := idempotency.begin(scope, fingerprint, time.Now())
+	if !owner {
+		if entry.fingerprint != fingerprint {
+			writeError(w, newAPIError(http.StatusUnprocessableEntity, "%s 已用于内容不同的请求", idempotencyKeyHeader))
+			return
+		}
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set(idempotencyReplayedHeader, "true")
+		w.WriteHeader(entry.status)
+		w.Write(entry.body)
+		return
+	}
+
+	rec := &recordingWriter{ResponseWriter: w}
+	defer func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		idempotency.complete(scope, entry, status, rec.body.Bytes(), time.Now())
+	}()
+	next(rec, r)
+}
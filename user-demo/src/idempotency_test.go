@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// idempotentRequest sends a POST with an optional key through
+// serveIdempotent
+func idempotentRequest(path, key, body string, next func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(idempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	serveIdempotent(w, r, next)
+	return w
+}
+
+func TestServeIdempotent(t *testing.T) {
+	type call struct {
+		path, key, body string
+		status          int
+		replayed        bool
+	}
+	tests := []struct {
+		name     string
+		upstream int // Status written by the handler
+		calls    []call
+		runs     int32 // Handler executions
+	}{
+		{"missing key", http.StatusOK, []call{
+			{"/pay", "", `{}`, http.StatusBadRequest, false},
+		}, 0},
+		{"invalid key", http.StatusOK, []call{
+			{"/pay", "bad key", `{}`, http.StatusBadRequest, false},
+			{"/pay", strings.Repeat("k", maxIdempotencyKeyLen+1), `{}`, http.StatusBadRequest, false},
+		}, 0},
+		{"replay", http.StatusOK, []call{
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, false},
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, true},
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, true},
+		}, 1},
+		{"different body under the same key", http.StatusOK, []call{
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, false},
+			{"/pay", "k1", `{"amount":20}`, http.StatusUnprocessableEntity, false},
+		}, 1},
+		{"different keys", http.StatusOK, []call{
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, false},
+			{"/pay", "k2", `{"amount":10}`, http.StatusOK, false},
+		}, 2},
+		{"keys are scoped to the route", http.StatusOK, []call{
+			{"/pay", "k1", `{"amount":10}`, http.StatusOK, false},
+			{"/vip", "k1", `{"amount":10}`, http.StatusOK, false},
+		}, 2},
+		{"failures can be retried", http.StatusBadGateway, []call{
+			{"/pay", "k1", `{"amount":10}`, http.StatusBadGateway, false},
+			{"/pay", "k1", `{"amount":10}`, http.StatusBadGateway, false},
+		}, 2},
+		{"body too large", http.StatusOK, []call{
+			{"/pay", "k1", `{"note":"` + strings.Repeat("x", maxBufferedBody) + `"}`, http.StatusRequestEntityTooLarge, false},
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idempotency = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+			var runs atomic.Int32
+			next := func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				n := runs.Add(1)
+				w.WriteHeader(tt.upstream)
+				w.Write([]byte(string(body) + "#" + strconv.Itoa(int(n))))
+			}
+
+			var first string
+			for i, c := range tt.calls {
+				w := idempotentRequest(c.path, c.key, c.body, next)
+				if w.Code != c.status {
+					t.Fatalf("call %d: status = %d, want %d (%s)", i, w.Code, c.status, w.Body)
+				}
+				if replayed := w.Header().Get(idempotencyReplayedHeader) == "true"; replayed != c.replayed {
+					t.Errorf("call %d: replayed = %v, want %v", i, replayed, c.replayed)
+				}
+				if c.replayed && w.Body.String() != first {
+					t.Errorf("call %d: replayed body %q, want %q", i, w.Body, first)
+				}
+				if i == 0 {
+					first = w.Body.String()
+				}
+			}
+			if got := runs.Load(); got != tt.runs {
+				t.Errorf("handler ran %d times, want %d", got, tt.runs)
+			}
+		})
+	}
+}
+
+func TestServeIdempotentConcurrent(t *testing.T) {
+	idempotency = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+	const clients = 20
+
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	next := func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		close(started)
+		<-release
+		w.Write([]byte(`{"success":true,"data":{"order_id":1}}`))
+	}
+
+	results := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = idempotentRequest("/pay", "k1", `{"amount":10}`, next)
+	}()
+	<-started
+	for i := 1; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = idempotentRequest("/pay", "k1", `{"amount":10}`, next)
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := runs.Load(); got != 1 {
+		t.Fatalf("handler ran %d times, want 1", got)
+	}
+	replayed := 0
+	for i, w := range results {
+		if w.Code != http.StatusOK || w.Body.String() != results[0].Body.String() {
+			t.Errorf("client %d: %d %q", i, w.Code, w.Body)
+		}
+		if w.Header().Get(idempotencyReplayedHeader) == "true" {
+			replayed++
+		}
+	}
+	if replayed != clients-1 {
+		t.Errorf("%d replayed responses, want %d", replayed, clients-1)
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +33,25 @@ var defaultConfig = Config{
 	UserAPIKey: "",
 	UserID:     0,
 	Port:       defaultPort,
+
+	BindAddress: defaultBindAddress,
+
+	ReadTimeout:       defaultReadTimeout,
+	ReadHeaderTimeout: defaultReadHeaderTimeout,
+	WriteTimeout:      defaultWriteTimeout,
+	IdleTimeout:       defaultIdleTimeout,
+	ShutdownTimeout:   defaultShutdownTimeout,
+
+	HistoryFile: defaultHistoryFile,
+
+	IdempotencyWindow: defaultIdempotencyWindow,
+
+	VIPReminderDays: defaultVIPReminderDays,
+
+	BalanceRuleInterval: defaultBalanceRuleInterval,
+	BalanceRuleLog:      defaultBalanceRuleLog,
+
+	AuditLog: defaultAuditLog,
 }
 
 // Config holds the application configuration
@@ -37,6 +60,52 @@ type Config struct {
 	UserAPIKey string `json:"user_api_key"` // Personal API key (from profile page)
 	UserID     uint   `json:"user_id"`      // User ID (required for API authentication)
 	Port       int    `json:"port"`         // Web server port (default: 8183)
+
+	// Access control for the web UI
+	BindAddress  string   `json:"bind_address"`  // Listen address (default: 127.0.0.1, use 0.0.0.0 for all interfaces)
+	AllowedCIDRs []string `json:"allowed_cidrs"` // Client networks allowed to connect (empty = all)
+	AdminToken   string   `json:"admin_token"`   // Password/token required for the whole UI (empty = disabled)
+
+	// Server timeouts in seconds
+	ReadTimeout       int `json:"read_timeout"`        // Max time to read a full request (default: 15)
+	ReadHeaderTimeout int `json:"read_header_timeout"` // Max time to read request headers (default: 5)
+	WriteTimeout      int `json:"write_timeout"`       // Max time to write a response (default: 45)
+	IdleTimeout       int `json:"idle_timeout"`        // Keep-alive idle timeout (default: 60)
+	ShutdownTimeout   int `json:"shutdown_timeout"`    // Max time to drain requests on exit (default: 30)
+
+	// HTTPS settings
+	TLSEnabled       bool   `json:"tls_enabled"`        // Serve the web UI over HTTPS
+	TLSCertFile      string `json:"tls_cert_file"`      // Certificate path (default: cert.pem, self-signed if missing)
+	TLSKeyFile       string `json:"tls_key_file"`       // Private key path (default: key.pem, self-signed if missing)
+	HTTPRedirectPort int    `json:"http_redirect_port"` // Plain HTTP port redirecting to HTTPS (0 = disabled)
+
+	// Desktop notifications (notify-send on Linux)
+	NotifyMessages      bool `json:"notify_messages"`       // Notify when a new message arrives
+	NotifyBalanceDebits bool `json:"notify_balance_debits"` // Notify when the balance decreases
+
+	// Local copy of messages, balance logs and payment orders
+	HistoryFile string `json:"history_file"` // bbolt file (default: history.db, empty = disabled)
+
+	// Payment notifications pushed by the login service
+	WebhookSecret string `json:"webhook_secret"` // HMAC secret for /webhooks/payment (empty = disabled)
+
+	// Seconds a payment Idempotency-Key is remembered (default: 86400)
+	IdempotencyWindow int `json:"idempotency_window"`
+
+	// VIP expiry reminders and auto-renewal
+	VIPReminderDays int                        `json:"vip_reminder_days"` // Warn this many days before expiry (default: 7, 0 = disabled)
+	NotifyVIPExpiry bool                       `json:"notify_vip_expiry"` // Desktop notification for expiry warnings and renewals
+	AutoRenew       map[uint]AutoRenewSettings `json:"auto_renew"`        // Per user ID, users without an entry never renew
+
+	// Low-balance rules checked in the background
+	BalanceRules        []BalanceRule `json:"balance_rules"`
+	BalanceRuleInterval int           `json:"balance_rule_interval"` // Seconds between checks (default: 300)
+	DailyTopUpCap       float64       `json:"daily_top_up_cap"`      // Most rules may recharge per day (0 = no automatic recharges)
+	BalanceRulesDryRun  bool          `json:"balance_rules_dry_run"` // Record recharges without creating orders
+	BalanceRuleLog      string        `json:"balance_rule_log"`      // Audit log of triggered rules (default: balance-rules.jsonl)
+
+	// Hash-chained log of state-changing actions
+	AuditLog string `json:"audit_log"` // JSON Lines file (default: audit.jsonl, empty = disabled)
 }
 
 // UserProfile represents the user profile from API
@@ -116,11 +185,61 @@ type BalanceLogsResponse struct {
 	PageSize int          `json:"page_size"`
 }
 
+// PaymentOrder represents a payment order
+type PaymentOrder struct {
+	ID            uint       `json:"id"`
+	OrderNo       string     `json:"order_no"`
+	ProductType   string     `json:"product_type"`
+	Amount        float64    `json:"amount"`
+	Status        string     `json:"status"`
+	PaymentMethod string     `json:"payment_method"`
+	PaidAt        *time.Time `json:"paid_at"`
+	ExpireAt      *time.Time `json:"expire_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// PaymentOrdersResponse represents payment orders list response
+type PaymentOrdersResponse struct {
+	Orders   []PaymentOrder `json:"orders"`
+	Total    int64          `json:"total"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+}
+
+// VIPLevel represents a purchasable VIP level
+type VIPLevel struct {
+	ID          uint      `json:"id"`
+	Level       int       `json:"level"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Price       float64   `json:"price,omitempty"`    // Price of one Duration, when Plans is empty
+	Duration    int       `json:"duration,omitempty"` // Days, when Plans is empty
+	Plans       []VIPPlan `json:"plans,omitempty"`
+}
+
+// VIPPlan represents a purchasable duration of a VIP level
+type VIPPlan struct {
+	Duration int     `json:"duration"` // Days
+	Price    float64 `json:"price"`
+}
+
+// RechargeSettings represents the recharge limits
+type RechargeSettings struct {
+	MinAmount      float64   `json:"min_amount"`
+	MaxAmount      float64   `json:"max_amount"` // 0 means no upper limit
+	Presets        []float64 `json:"presets"`
+	AllowCustom    *bool     `json:"allow_custom"` // false restricts amounts to Presets
+	PaymentMethods []string  `json:"payment_methods"`
+}
+
 // APIResponse represents a generic API response
 type APIResponse struct {
 	Success bool            `json:"success"`
 	Message string          `json:"message,omitempty"`
 	Data    json.RawMessage `json:"data,omitempty"`
+
+	StatusCode int `json:"-"` // Upstream HTTP status, set by makePublicRequest
 }
 
 // PageData holds data for template rendering
@@ -133,69 +252,226 @@ type PageData struct {
 	Success      string
 	IsConfigured bool
 	HasToken     bool
+	CSRFToken    string
+	AutoRenew    AutoRenewSettings // Setting of the configured user
+}
+
+var (
+	configMu  sync.Mutex // Serializes config updates and writes to the config file
+	configPtr atomic.Pointer[Config]
+)
+
+// currentConfig returns the current configuration. The value is shared
+// between goroutines and must not be modified; see updateConfig.
+// Background workers take one snapshot per run so they see consistent
+// settings.
+func currentConfig() *Config {
+	return configPtr.Load()
+}
+
+// updateConfig applies fn to a copy of the configuration and publishes
+// the copy. Slices and maps are shared with the old value, so fn must
+// replace rather than modify them.
+func updateConfig(fn func(c *Config)) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	next := *configPtr.Load()
+	fn(&next)
+	configPtr.Store(&next)
+}
+
+var (
+	tokenMu      sync.RWMutex
+	cachedToken  string // Cache the JWT token for subsequent requests
+	cachedUserID uint   // User the cached token was issued for
+)
+
+// getCachedToken returns the cached JWT token
+func getCachedToken() string {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return cachedToken
 }
 
-var config Config
-var cachedToken string // Cache the JWT token for subsequent requests
+// cachedSession returns the cached JWT token and its user together, for
+// work that must not mix one session's token with another's user
+func cachedSession() (token string, userID uint) {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return cachedToken, cachedUserID
+}
+
+// setCachedToken replaces the cached JWT token with one issued for the
+// configured user
+func setCachedToken(token string) {
+	setSession(token, currentConfig().UserID)
+}
+
+// setSession replaces the cached JWT token and records its user. The
+// configured user ID is published before the token, so the workers
+// woken below never see the new token with the previous user.
+func setSession(token string, userID uint) {
+	if token != "" && userID != 0 && currentConfig().UserID != userID {
+		updateConfig(func(c *Config) { c.UserID = userID })
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	cachedToken, cachedUserID = token, userID
+
+	// Pull new history for the session into the local store
+	if token != "" && localStore != nil {
+		requestHistorySync()
+	}
+	// Check the VIP expiry of the new session
+	if token != "" {
+		requestVIPCheck()
+	}
+}
 
 func main() {
 	// Load configuration
-	config = loadConfig()
-
-	// Setup HTTP handlers
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/config", handleConfig)
-	http.HandleFunc("/api/profile", handleAPIProfile)
-	http.HandleFunc("/api/balance", handleAPIBalance)
-	http.HandleFunc("/api/token", handleAPIToken)
-	// JWT token authenticated endpoints
-	http.HandleFunc("/api/jwt/profile", handleJWTProfile)
-	http.HandleFunc("/api/jwt/messages", handleJWTMessages)
-	http.HandleFunc("/api/jwt/unread-count", handleJWTUnreadCount)
-	http.HandleFunc("/api/jwt/balance-logs", handleJWTBalanceLogs)
-	http.HandleFunc("/api/jwt/update-profile", handleJWTUpdateProfile)
-	http.HandleFunc("/api/jwt/balance", handleJWTBalance)
-	http.HandleFunc("/api/jwt/third-party-status", handleJWTThirdPartyStatus)
-	http.HandleFunc("/api/jwt/payment-orders", handleJWTPaymentOrders)
-	http.HandleFunc("/api/jwt/read-all-messages", handleJWTReadAllMessages)
+	cfg := loadConfig()
+	// Rule names are filled in before the config is shared
+	rulesErr := validateBalanceRules(cfg.BalanceRules)
+	configPtr.Store(&cfg)
+
+	// Run a command-line subcommand instead of the web server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// Setup HTTP handlers (GET patterns also match HEAD; other methods get 405)
+	http.HandleFunc("GET /{$}", handleHome)
+	http.HandleFunc("GET /dashboard", handleDashboard)
+	http.HandleFunc("GET /audit", handleAudit)
+	http.HandleFunc("POST /config", handleConfig)
 	// Browser login
-	http.HandleFunc("/open-browser", handleOpenBrowser)
-	http.HandleFunc("/api/token-status", handleTokenStatus)
-	// Username/password login with captcha
-	http.HandleFunc("/api/captcha/status", handleCaptchaStatus)
-	http.HandleFunc("/api/captcha/generate", handleCaptchaGenerate)
-	http.HandleFunc("/api/captcha/verify", handleCaptchaVerify)
-	http.HandleFunc("/api/login", handleLogin)
-	// Registration
-	http.HandleFunc("/api/register", handleRegister)
-	// VIP and Recharge related endpoints (public API)
-	http.HandleFunc("/api/vip-levels", handleVIPLevels)
-	http.HandleFunc("/api/recharge-settings", handleRechargeSettings)
-	// VIP purchase and recharge (JWT authenticated)
-	http.HandleFunc("/api/jwt/purchase-vip", handleJWTPurchaseVIP)
-	http.HandleFunc("/api/jwt/recharge", handleJWTRecharge)
-
-	port := config.Port
+	http.HandleFunc("POST /open-browser", handleOpenBrowser)
+	http.HandleFunc("GET /api/token-status", handleTokenStatus)
+	// Endpoints forwarded to the login service
+	registerProxyRoutes(http.DefaultServeMux)
+	http.HandleFunc("GET /api/jwt/messages/all", handleJWTMessagesAll)
+	http.HandleFunc("GET /api/jwt/events", handleJWTEvents)
+	http.HandleFunc("GET /api/jwt/balance-logs/export", handleJWTBalanceLogsExport)
+	http.HandleFunc("GET /api/jwt/balance-logs/reconcile", handleJWTBalanceReconcile)
+	http.HandleFunc("GET /api/jwt/analytics", handleJWTAnalytics)
+	http.HandleFunc("GET /api/jwt/messages/search", handleJWTMessageSearch)
+	http.HandleFunc("GET /api/jwt/sync", handleJWTSyncStatus)
+	http.HandleFunc("POST /api/jwt/sync", handleJWTSync)
+	http.HandleFunc("GET /api/jwt/payment-orders/tracked", handleJWTTrackedOrders)
+	http.HandleFunc("POST /webhooks/payment", handlePaymentWebhook)
+	http.HandleFunc("GET /api/jwt/vip-comparison", handleJWTVIPComparison)
+	http.HandleFunc("GET /api/jwt/vip-status", handleJWTVIPStatus)
+	http.HandleFunc("GET /api/balance-rules", handleBalanceRules)
+	http.HandleFunc("POST /api/balance-rules/check", handleBalanceRulesCheck)
+	http.HandleFunc("GET /api/balance-rules/log", handleBalanceRulesLog)
+	http.HandleFunc("GET /api/audit", handleAuditEntries)
+	http.HandleFunc("GET /api/audit/export", handleAuditExport)
+
+	port := cfg.Port
 	if port == 0 {
 		port = defaultPort
 	}
 
-	addr := fmt.Sprintf(":%d", port)
+	allowedCIDRs, err := parseAllowedCIDRs(cfg.AllowedCIDRs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rulesErr != nil {
+		log.Fatal(rulesErr)
+	}
+	if !isLoopbackBind(cfg.BindAddress) && len(allowedCIDRs) == 0 && cfg.AdminToken == "" {
+		log.Printf("警告: 监听地址 %q 可被其他机器访问，建议配置 allowed_cidrs 或 admin_token", cfg.BindAddress)
+	}
+
+	var handler http.Handler = withAccessControl(withCSRF(withJSONErrors(http.DefaultServeMux)), allowedCIDRs, cfg.AdminToken)
+
+	addr := net.JoinHostPort(cfg.BindAddress, strconv.Itoa(port))
+	srv := newServer(addr, handler)
+	servers := []*http.Server{srv}
+	scheme := "http"
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := loadTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig
+		srv.Handler = withHSTS(handler)
+		scheme = "https"
+
+		if cfg.HTTPRedirectPort != 0 {
+			redirectAddr := net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.HTTPRedirectPort))
+			servers = append(servers, newServer(redirectAddr, httpsRedirectHandler(port)))
+		}
+	}
+
+	uiURL := fmt.Sprintf("%s://%s:%d", scheme, displayHost(cfg.BindAddress), port)
 	fmt.Printf("========================================\n")
 	fmt.Printf("  User API Web 示例程序\n")
 	fmt.Printf("========================================\n")
-	fmt.Printf("🌐 Web界面: http://localhost%s\n", addr)
+	fmt.Printf("🌐 Web界面: %s\n", uiURL)
+	if len(servers) > 1 {
+		fmt.Printf("↪️  HTTP 重定向: http://%s:%d\n", displayHost(cfg.BindAddress), cfg.HTTPRedirectPort)
+	}
 	fmt.Printf("========================================\n")
 
 	// Auto-open browser on Windows
 	if runtime.GOOS == "windows" {
 		go func() {
 			time.Sleep(500 * time.Millisecond)
-			openBrowser(fmt.Sprintf("http://localhost%s", addr))
+			openBrowser(uiURL)
 		}()
 	}
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	// Local history store for offline browsing and search
+	if cfg.HistoryFile != "" {
+		store, err := openHistoryStore(cfg.HistoryFile)
+		if err != nil {
+			log.Printf("警告: %v，离线缓存已禁用", err)
+		} else {
+			localStore = store
+			startHistorySync()
+			onShutdown(func() {
+				historySyncMu.Lock()
+				defer historySyncMu.Unlock()
+				store.Close()
+			})
+		}
+	}
+
+	// Audit log of state-changing actions
+	if cfg.AuditLog != "" {
+		l, err := openAuditLog(cfg.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit = l
+	}
+
+	// Desktop notifications for account events
+	notifications.configure(cfg.NotifyMessages, cfg.NotifyBalanceDebits, cfg.NotifyVIPExpiry, len(cfg.BalanceRules) > 0)
+
+	// VIP expiry reminders and auto-renewal
+	startVIPScheduler()
+
+	// Low-balance alerts and top-ups
+	startBalanceRules()
+
+	// Verified payment webhooks update tracked orders and the local copy
+	onPaymentNotification(tracker.notify)
+	onPaymentNotification(cacheNotifiedOrder)
+
+	// Wait for pending config writes before exiting
+	onShutdown(func() {
+		configMu.Lock()
+		defer configMu.Unlock()
+	})
+
+	if err := runServer(servers...); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // openBrowser opens the specified URL in the default browser
@@ -218,13 +494,11 @@ func openBrowser(url string) error {
 
 // handleOpenBrowser opens the login page in browser
 func handleOpenBrowser(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
 	w.Header().Set("Content-Type", "application/json")
 
-	if config.ServerURL == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先配置服务器地址",
-		})
+	if cfg.ServerURL == "" {
+		writeError(w, errNotConfigured)
 		return
 	}
 
@@ -232,20 +506,17 @@ func handleOpenBrowser(w http.ResponseWriter, r *http.Request) {
 	var url string
 	switch target {
 	case "login":
-		url = config.ServerURL + "/login"
+		url = cfg.ServerURL + "/login"
 	case "profile":
-		url = config.ServerURL + "/profile"
+		url = cfg.ServerURL + "/profile"
 	case "register":
-		url = config.ServerURL + "/register"
+		url = cfg.ServerURL + "/register"
 	default:
-		url = config.ServerURL
+		url = cfg.ServerURL
 	}
 
 	if err := openBrowser(url); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "打开浏览器失败: " + err.Error(),
-		})
+		writeError(w, newAPIError(http.StatusInternalServerError, "打开浏览器失败: %v", err))
 		return
 	}
 
@@ -262,7 +533,7 @@ func handleTokenStatus(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":   true,
-		"has_token": cachedToken != "",
+		"has_token": getCachedToken() != "",
 	})
 }
 
@@ -275,6 +546,7 @@ func loadConfig() Config {
 		if err := json.Unmarshal(data, &cfg); err != nil {
 			log.Printf("警告: 解析配置文件 %s 失败: %v", configFileName, err)
 		} else {
+			migrateAutoRenew(&cfg, data)
 			log.Printf("已从 %s 加载配置", configFileName)
 		}
 	} else if os.IsNotExist(err) {
@@ -303,6 +575,15 @@ func loadConfig() Config {
 			cfg.Port = p
 		}
 	}
+	if bindAddress := os.Getenv("BIND_ADDRESS"); bindAddress != "" {
+		cfg.BindAddress = bindAddress
+	}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		cfg.AdminToken = adminToken
+	}
+	if webhookSecret := os.Getenv("WEBHOOK_SECRET"); webhookSecret != "" {
+		cfg.WebhookSecret = webhookSecret
+	}
 
 	// Normalize server URL (remove trailing slash)
 	cfg.ServerURL = strings.TrimSuffix(cfg.ServerURL, "/")
@@ -312,9 +593,38 @@ func loadConfig() Config {
 		cfg.Port = defaultPort
 	}
 
+	// Default to loopback so the UI is not exposed to the network
+	if cfg.BindAddress == "" {
+		cfg.BindAddress = defaultBindAddress
+	}
+
 	return cfg
 }
 
+// migrateAutoRenew moves the single auto-renewal switch of older config
+// files to the user the file was configured for
+func migrateAutoRenew(cfg *Config, data []byte) {
+	var legacy struct {
+		AutoRenewVIP       bool    `json:"auto_renew_vip"`
+		AutoRenewMaxAmount float64 `json:"auto_renew_max_amount"`
+		AutoRenewDuration  int     `json:"auto_renew_duration"`
+	}
+	if json.Unmarshal(data, &legacy) != nil || cfg.UserID == 0 {
+		return
+	}
+	if _, ok := cfg.AutoRenew[cfg.UserID]; ok || (!legacy.AutoRenewVIP && legacy.AutoRenewMaxAmount == 0 && legacy.AutoRenewDuration == 0) {
+		return
+	}
+	if cfg.AutoRenew == nil {
+		cfg.AutoRenew = make(map[uint]AutoRenewSettings)
+	}
+	cfg.AutoRenew[cfg.UserID] = AutoRenewSettings{
+		Enabled:   legacy.AutoRenewVIP,
+		MaxAmount: legacy.AutoRenewMaxAmount,
+		Duration:  legacy.AutoRenewDuration,
+	}
+}
+
 // generateDefaultConfig generates a default config.json file
 func generateDefaultConfig() error {
 	data, err := json.MarshalIndent(defaultConfig, "", "  ")
@@ -326,7 +636,10 @@ func generateDefaultConfig() error {
 
 // saveConfig saves the current configuration to file
 func saveConfig() error {
-	data, err := json.MarshalIndent(config, "", "  ")
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	data, err := json.MarshalIndent(currentConfig(), "", "  ")
 	if err != nil {
 		return err
 	}
@@ -335,15 +648,13 @@ func saveConfig() error {
 
 // handleHome renders the main page
 func handleHome(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
-	}
-
+	cfg := currentConfig()
 	data := PageData{
-		Config:       config,
-		IsConfigured: config.ServerURL != "" && config.UserAPIKey != "" && config.UserID != 0,
-		HasToken:     cachedToken != "",
+		Config:       *cfg,
+		IsConfigured: cfg.ServerURL != "" && cfg.UserAPIKey != "" && cfg.UserID != 0,
+		AutoRenew:    cfg.autoRenewFor(cfg.UserID),
+		HasToken:     getCachedToken() != "",
+		CSRFToken:    ensureCSRFToken(w, r),
 	}
 
 	renderTemplate(w, "index.html", data)
@@ -351,409 +662,93 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 
 // handleConfig handles configuration updates
 func handleConfig(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		config.ServerURL = strings.TrimSuffix(r.FormValue("server_url"), "/")
-		config.UserAPIKey = r.FormValue("user_api_key")
-		if uid, err := strconv.ParseUint(r.FormValue("user_id"), 10, 32); err == nil {
-			config.UserID = uint(uid)
-		}
-
-		// Clear cached token when config changes
-		cachedToken = ""
-
-		if err := saveConfig(); err != nil {
-			http.Error(w, "保存配置失败", http.StatusInternalServerError)
+	session := sessionFingerprint(getCachedToken())
+
+	// Auto-renewal orders must use a method the login service accepts
+	renewMethod := strings.TrimSpace(r.FormValue("auto_renew_payment_method"))
+	if r.FormValue("auto_renew_vip") != "" {
+		if err := checkAutoRenewPaymentMethod(renewMethod); err != nil {
+			status := errorStatus(err)
+			recordAudit(clientIP(r), session, auditConfigSave, redactForm(r.PostForm), status, false, err.Error())
+			http.Error(w, "自动续费支付方式无效: "+err.Error(), status)
 			return
 		}
-
-		http.Redirect(w, r, "/?success=config_saved", http.StatusSeeOther)
-		return
-	}
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// handleAPIProfile fetches and returns user profile
-func handleAPIProfile(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	profile, err := fetchProfile()
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    profile,
-	})
-}
-
-// handleAPIBalance fetches and returns user balance
-func handleAPIBalance(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	balance, err := fetchBalance()
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    balance,
-	})
-}
-
-// handleAPIToken exchanges API key for access token
-func handleAPIToken(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	token, err := exchangeForToken()
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	// Cache the token for subsequent JWT requests
-	cachedToken = token.AccessToken
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    token,
-	})
-}
-
-// handleJWTProfile fetches profile using JWT token
-func handleJWTProfile(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/auth/profile", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	var profile UserProfile
-	if err := json.Unmarshal(resp.Data, &profile); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "解析响应失败: " + err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    profile,
-	})
-}
-
-// handleJWTMessages fetches messages using JWT token
-func handleJWTMessages(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/messages?page=1&page_size=10", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	var messages MessagesResponse
-	if err := json.Unmarshal(resp.Data, &messages); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "解析响应失败: " + err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    messages,
-	})
-}
-
-// handleJWTUnreadCount fetches unread message count using JWT token
-func handleJWTUnreadCount(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/messages/unread-count", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	var unread UnreadCountResponse
-	if err := json.Unmarshal(resp.Data, &unread); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "解析响应失败: " + err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    unread,
-	})
-}
-
-// handleJWTBalanceLogs fetches balance logs using JWT token
-func handleJWTBalanceLogs(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/auth/user-logs/balance?page=1&page_size=10", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	var logs BalanceLogsResponse
-	if err := json.Unmarshal(resp.Data, &logs); err != nil {
-		// Return raw data if parsing fails
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"data":    json.RawMessage(resp.Data),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    logs,
-	})
-}
-
-// handleJWTUpdateProfile updates user profile using JWT token
-func handleJWTUpdateProfile(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
 	}
 
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	// Parse request body
-	var updateData map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("PUT", "/api/auth/profile", updateData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleJWTBalance fetches user balance using JWT token
-func handleJWTBalance(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/auth/balance", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleJWTThirdPartyStatus fetches third-party binding status using JWT token
-func handleJWTThirdPartyStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	resp, err := makeJWTRequest("GET", "/api/auth/third-party-status", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleJWTPaymentOrders fetches payment orders using JWT token
-func handleJWTPaymentOrders(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	updateConfig(func(c *Config) {
+		c.ServerURL = strings.TrimSuffix(r.FormValue("server_url"), "/")
+		c.UserAPIKey = r.FormValue("user_api_key")
+		if uid, err := strconv.ParseUint(r.FormValue("user_id"), 10, 32); err == nil {
+			c.UserID = uint(uid)
+		}
 
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
+		c.NotifyMessages = r.FormValue("notify_messages") != ""
+		c.NotifyBalanceDebits = r.FormValue("notify_balance_debits") != ""
+		c.NotifyVIPExpiry = r.FormValue("notify_vip_expiry") != ""
 
-	resp, err := makeJWTRequest("GET", "/api/auth/user-logs/payment-orders?page=1&page_size=10", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
+		if days, err := strconv.Atoi(r.FormValue("vip_reminder_days")); err == nil && days >= 0 {
+			c.VIPReminderDays = days
+		}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
+		// Auto-renewal belongs to the user the form is saved for
+		renewal := c.autoRenewFor(c.UserID)
+		renewal.Enabled = r.FormValue("auto_renew_vip") != ""
+		if amount, err := strconv.ParseFloat(r.FormValue("auto_renew_max_amount"), 64); err == nil && amount >= 0 {
+			renewal.MaxAmount = amount
+		}
+		if days, err := strconv.Atoi(r.FormValue("auto_renew_duration")); err == nil && days >= 0 {
+			renewal.Duration = days
+		}
+		if renewMethod != "" {
+			renewal.PaymentMethod = renewMethod
+		}
+		if c.UserID != 0 {
+			c.AutoRenew = maps.Clone(c.AutoRenew)
+			if c.AutoRenew == nil {
+				c.AutoRenew = make(map[uint]AutoRenewSettings)
+			}
+			c.AutoRenew[c.UserID] = renewal
+		}
 	})
-}
-
-// handleJWTReadAllMessages marks all messages as read using JWT token
-func handleJWTReadAllMessages(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	cfg := currentConfig()
+	notifications.configure(cfg.NotifyMessages, cfg.NotifyBalanceDebits, cfg.NotifyVIPExpiry, len(cfg.BalanceRules) > 0)
 
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
+	// Clear cached token when config changes
+	setCachedToken("")
 
-	resp, err := makeJWTRequest("POST", "/api/messages/read-all", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+	if err := saveConfig(); err != nil {
+		recordAudit(clientIP(r), session, auditConfigSave, redactForm(r.PostForm), http.StatusInternalServerError, false, err.Error())
+		http.Error(w, "保存配置失败", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(clientIP(r), session, auditConfigSave, redactForm(r.PostForm), http.StatusSeeOther, true, "")
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": resp.Message,
-	})
+	http.Redirect(w, r, "/?success=config_saved", http.StatusSeeOther)
 }
 
 // makeAPIRequest makes an authenticated API request using API Key
 func makeAPIRequest(method, endpoint string) (*APIResponse, error) {
-	if config.ServerURL == "" {
-		return nil, fmt.Errorf("服务器地址未配置")
+	cfg := currentConfig()
+	if cfg.ServerURL == "" {
+		return nil, errNoServerURL
 	}
-	if config.UserAPIKey == "" {
-		return nil, fmt.Errorf("API密钥未配置")
+	if cfg.UserAPIKey == "" {
+		return nil, errNoAPIKey
 	}
-	if config.UserID == 0 {
-		return nil, fmt.Errorf("用户ID未配置")
+	if cfg.UserID == 0 {
+		return nil, errNoUserID
 	}
 
-	url := config.ServerURL + endpoint
+	url := cfg.ServerURL + endpoint
 
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("创建请求失败: %v", err)
+		return nil, newAPIError(http.StatusInternalServerError, "创建请求失败: %v", err)
 	}
 
 	// Set required headers (both API Key and User ID)
-	req.Header.Set("X-User-API-Key", config.UserAPIKey)
-	req.Header.Set("X-User-ID", strconv.FormatUint(uint64(config.UserID), 10))
+	req.Header.Set("X-User-API-Key", cfg.UserAPIKey)
+	req.Header.Set("X-User-ID", strconv.FormatUint(uint64(cfg.UserID), 10))
 	req.Header.Set("Accept", "application/json")
 
 	client := &http.Client{
@@ -762,22 +757,22 @@ func makeAPIRequest(method, endpoint string) (*APIResponse, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("请求失败: %v", err)
+		return nil, transportError(err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("读取响应失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "读取响应失败: %v", err)
 	}
 
 	var apiResp APIResponse
 	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %v, body: %s", err, string(body))
+		return nil, newAPIError(parseFailureStatus(resp.StatusCode), "解析响应失败: %v, body: %s", err, string(body))
 	}
 
 	if !apiResp.Success {
-		return nil, fmt.Errorf("API错误: %s", apiResp.Message)
+		return nil, newAPIError(upstreamStatus(resp.StatusCode), "API错误: %s", apiResp.Message)
 	}
 
 	return &apiResp, nil
@@ -785,34 +780,53 @@ func makeAPIRequest(method, endpoint string) (*APIResponse, error) {
 
 // makeJWTRequest makes an authenticated API request using JWT token
 func makeJWTRequest(method, endpoint string, body interface{}) (*APIResponse, error) {
-	if config.ServerURL == "" {
-		return nil, fmt.Errorf("服务器地址未配置")
+	return makeJWTRequestWithHeader(method, endpoint, body, nil)
+}
+
+// makeJWTRequestWithHeader makes a JWT request with extra request headers
+func makeJWTRequestWithHeader(method, endpoint string, body interface{}, header http.Header) (*APIResponse, error) {
+	return makeTokenRequest(getCachedToken(), method, endpoint, body, header)
+}
+
+// makeTokenRequest makes a JWT request with the given token instead of
+// the cached one, for background jobs that keep their own token
+func makeTokenRequest(token, method, endpoint string, body interface{}, header http.Header) (*APIResponse, error) {
+	cfg := currentConfig()
+	if cfg.ServerURL == "" {
+		return nil, errNoServerURL
 	}
-	if cachedToken == "" {
-		return nil, fmt.Errorf("JWT Token未获取")
+	if token == "" {
+		return nil, errTokenMissing
 	}
 
-	url := config.ServerURL + endpoint
+	url := cfg.ServerURL + endpoint
 
 	var reqBody io.Reader
-	if body != nil {
+	contentType := "application/json"
+	if raw, ok := body.(rawBody); ok {
+		reqBody, contentType = bytes.NewReader(raw.Data), raw.ContentType
+	} else if body != nil {
 		jsonBody, err := json.Marshal(body)
 		if err != nil {
-			return nil, fmt.Errorf("序列化请求体失败: %v", err)
+			return nil, newAPIError(http.StatusInternalServerError, "序列化请求体失败: %v", err)
 		}
 		reqBody = bytes.NewReader(jsonBody)
 	}
 
 	req, err := http.NewRequest(method, url, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("创建请求失败: %v", err)
+		return nil, newAPIError(http.StatusInternalServerError, "创建请求失败: %v", err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
 	}
 
 	// Set JWT Authorization header
-	req.Header.Set("Authorization", "Bearer "+cachedToken)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Accept", "application/json")
 	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", contentType)
 	}
 
 	client := &http.Client{
@@ -821,22 +835,22 @@ func makeJWTRequest(method, endpoint string, body interface{}) (*APIResponse, er
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("请求失败: %v", err)
+		return nil, transportError(err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("读取响应失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "读取响应失败: %v", err)
 	}
 
 	var apiResp APIResponse
 	if err := json.Unmarshal(respBody, &apiResp); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %v, body: %s", err, string(respBody))
+		return nil, newAPIError(parseFailureStatus(resp.StatusCode), "解析响应失败: %v, body: %s", err, string(respBody))
 	}
 
 	if !apiResp.Success {
-		return nil, fmt.Errorf("API错误: %s", apiResp.Message)
+		return nil, newAPIError(upstreamStatus(resp.StatusCode), "API错误: %s", apiResp.Message)
 	}
 
 	return &apiResp, nil
@@ -851,7 +865,7 @@ func fetchProfile() (*UserProfile, error) {
 
 	var profile UserProfile
 	if err := json.Unmarshal(resp.Data, &profile); err != nil {
-		return nil, fmt.Errorf("解析用户资料失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "解析用户资料失败: %v", err)
 	}
 
 	return &profile, nil
@@ -866,7 +880,7 @@ func fetchBalance() (*UserBalance, error) {
 
 	var balance UserBalance
 	if err := json.Unmarshal(resp.Data, &balance); err != nil {
-		return nil, fmt.Errorf("解析余额信息失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "解析余额信息失败: %v", err)
 	}
 
 	return &balance, nil
@@ -881,7 +895,7 @@ func exchangeForToken() (*TokenResponse, error) {
 
 	var token TokenResponse
 	if err := json.Unmarshal(resp.Data, &token); err != nil {
-		return nil, fmt.Errorf("解析令牌失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "解析令牌失败: %v", err)
 	}
 
 	return &token, nil
@@ -897,24 +911,25 @@ func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
 
 // makePublicRequest makes a public API request (no auth required)
 func makePublicRequest(method, endpoint string, body interface{}) (*APIResponse, error) {
-	if config.ServerURL == "" {
-		return nil, fmt.Errorf("服务器地址未配置")
+	cfg := currentConfig()
+	if cfg.ServerURL == "" {
+		return nil, errNoServerURL
 	}
 
-	url := config.ServerURL + endpoint
+	url := cfg.ServerURL + endpoint
 
 	var reqBody io.Reader
 	if body != nil {
 		jsonBody, err := json.Marshal(body)
 		if err != nil {
-			return nil, fmt.Errorf("序列化请求体失败: %v", err)
+			return nil, newAPIError(http.StatusInternalServerError, "序列化请求体失败: %v", err)
 		}
 		reqBody = bytes.NewReader(jsonBody)
 	}
 
 	req, err := http.NewRequest(method, url, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("创建请求失败: %v", err)
+		return nil, newAPIError(http.StatusInternalServerError, "创建请求失败: %v", err)
 	}
 
 	req.Header.Set("Accept", "application/json")
@@ -928,343 +943,21 @@ func makePublicRequest(method, endpoint string, body interface{}) (*APIResponse,
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("请求失败: %v", err)
+		return nil, transportError(err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("读取响应失败: %v", err)
+		return nil, newAPIError(http.StatusBadGateway, "读取响应失败: %v", err)
 	}
 
 	var apiResp APIResponse
 	if err := json.Unmarshal(respBody, &apiResp); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %v, body: %s", err, string(respBody))
+		return nil, newAPIError(parseFailureStatus(resp.StatusCode), "解析响应失败: %v, body: %s", err, string(respBody))
 	}
+	apiResp.StatusCode = resp.StatusCode
 
 	return &apiResp, nil
 }
 
-// handleCaptchaStatus gets captcha status from server
-func handleCaptchaStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	resp, err := makePublicRequest("GET", "/api/captcha/status", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleCaptchaGenerate generates a new captcha
-func handleCaptchaGenerate(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	resp, err := makePublicRequest("POST", "/api/captcha/generate", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleCaptchaVerify verifies a captcha
-func handleCaptchaVerify(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
-	}
-
-	// Parse request body
-	var verifyData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&verifyData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	resp, err := makePublicRequest("POST", "/api/captcha/verify", verifyData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": resp.Success,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleLogin handles username/password login with captcha
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
-	}
-
-	// Parse request body
-	var loginData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	resp, err := makePublicRequest("POST", "/api/auth/login", loginData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	// If login successful, extract and cache the token
-	if resp.Success && resp.Data != nil {
-		var loginResp struct {
-			Token string `json:"token"`
-			User  struct {
-				ID          uint   `json:"id"`
-				Username    string `json:"username"`
-				Email       string `json:"email"`
-				DisplayName string `json:"display_name"`
-			} `json:"user"`
-		}
-		if err := json.Unmarshal(resp.Data, &loginResp); err == nil && loginResp.Token != "" {
-			cachedToken = loginResp.Token
-			// Update config with user ID
-			config.UserID = loginResp.User.ID
-		}
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": resp.Success,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleRegister handles user registration with captcha
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
-	}
-
-	// Parse request body
-	var registerData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&registerData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	resp, err := makePublicRequest("POST", "/api/auth/register", registerData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	// If registration successful, extract and cache the token
-	if resp.Success && resp.Data != nil {
-		var registerResp struct {
-			Token string `json:"token"`
-			User  struct {
-				ID          uint   `json:"id"`
-				Username    string `json:"username"`
-				Email       string `json:"email"`
-				DisplayName string `json:"display_name"`
-			} `json:"user"`
-		}
-		if err := json.Unmarshal(resp.Data, &registerResp); err == nil && registerResp.Token != "" {
-			cachedToken = registerResp.Token
-			// Update config with user ID
-			config.UserID = registerResp.User.ID
-		}
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": resp.Success,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleVIPLevels gets available VIP levels from public API
-func handleVIPLevels(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	resp, err := makePublicRequest("GET", "/api/vip-levels", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleRechargeSettings gets recharge settings from public API
-func handleRechargeSettings(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	resp, err := makePublicRequest("GET", "/api/recharge-settings", nil)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleJWTPurchaseVIP handles VIP purchase using JWT token
-func handleJWTPurchaseVIP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
-	}
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	// Parse request body
-	var purchaseData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&purchaseData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	// Set product_type to "vip"
-	purchaseData["product_type"] = "vip"
-
-	resp, err := makeJWTRequest("POST", "/api/payment/create", purchaseData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
-
-// handleJWTRecharge handles balance recharge using JWT token
-func handleJWTRecharge(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Method not allowed",
-		})
-		return
-	}
-
-	if cachedToken == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "请先获取Token",
-		})
-		return
-	}
-
-	// Parse request body
-	var rechargeData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&rechargeData); err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Invalid request body",
-		})
-		return
-	}
-
-	// Set product_type to "recharge"
-	rechargeData["product_type"] = "recharge"
-
-	resp, err := makeJWTRequest("POST", "/api/payment/create", rechargeData)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": resp.Message,
-		"data":    json.RawMessage(resp.Data),
-	})
-}
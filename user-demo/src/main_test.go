@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain publishes the default config, which handlers and workers
+// read through currentConfig
+func TestMain(m *testing.M) {
+	cfg := defaultConfig
+	configPtr.Store(&cfg)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleJWTMessagesAll streams every message matching the filters as
+// JSON Lines, walking all upstream pages. A failure after streaming has
+// started is reported as a final {"success": false, "error"} line.
+func handleJWTMessagesAll(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	query, err := messageQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	query.Del("page")
+	query.Del("page_size")
+
+	rc := http.NewResponseController(w)
+	writeTimeout := secondsOrDefault(currentConfig().WriteTimeout, defaultWriteTimeout)
+	enc := json.NewEncoder(w)
+	started := false
+
+	err = walkPages("/api/messages", query, func(data json.RawMessage) (int, int64, error) {
+		var page MessagesResponse
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, 0, err
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+			started = true
+		}
+		// Each page gets a fresh write deadline so long walks are not cut off
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		for _, msg := range page.Messages {
+			enc.Encode(msg)
+		}
+		rc.Flush()
+
+		return len(page.Messages), page.Total, nil
+	})
+
+	if err != nil {
+		if !started {
+			writeError(w, err)
+			return
+		}
+		enc.Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+// notifier shows a desktop notification. Implementations exist per
+// platform; newNotifier picks the one for the running system.
+type notifier interface {
+	Notify(title, body string) error
+}
+
+// notifySend shows notifications with libnotify's notify-send on Linux
+// and the BSDs
+type notifySend struct {
+	path string
+}
+
+func (n notifySend) Notify(title, body string) error {
+	return exec.Command(n.path, "--app-name=User API Demo", title, body).Run()
+}
+
+// newNotifier returns the notifier for the current platform, or nil
+// when desktop notifications are not available
+func newNotifier() notifier {
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		if path, err := exec.LookPath("notify-send"); err == nil {
+			return notifySend{path: path}
+		}
+	}
+	return nil
+}
+
+// desktopNotifications subscribes to the event hub while at least one
+// notification type is enabled and forwards matching events to the
+// platform notifier
+type desktopNotifications struct {
+	mu       sync.Mutex
+	notifier notifier
+	messages bool // New messages
+	debits   bool // Balance decreases
+	vip      bool // VIP expiry warnings and auto-renewals
+	rules    bool // Triggered balance rules
+	stop     chan struct{}
+}
+
+var notifications = &desktopNotifications{}
+
+// configure applies the opt-in settings, starting or stopping the watcher
+func (d *desktopNotifications) configure(messages, debits, vip, rules bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.messages, d.debits, d.vip, d.rules = messages, debits, vip, rules
+	enabled := messages || debits || vip || rules
+
+	if enabled && d.notifier == nil {
+		if d.notifier = newNotifier(); d.notifier == nil {
+			log.Printf("警告: 当前系统不支持桌面通知（%s 需要 notify-send）", runtime.GOOS)
+			return
+		}
+	}
+
+	switch {
+	case enabled && d.notifier != nil && d.stop == nil:
+		d.stop = make(chan struct{})
+		go d.watch(d.stop)
+	case !enabled && d.stop != nil:
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+// watch forwards hub events until stop is closed or the server shuts down
+func (d *desktopNotifications) watch(stop chan struct{}) {
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-serverClosing:
+			return
+		case ev := <-ch:
+			d.handle(ev)
+		}
+	}
+}
+
+// handle shows a notification for an event if its type is enabled
+func (d *desktopNotifications) handle(ev event) {
+	d.mu.Lock()
+	n, messages, debits, vip, rules := d.notifier, d.messages, d.debits, d.vip, d.rules
+	d.mu.Unlock()
+
+	var title, body string
+	switch data := ev.Data.(type) {
+	case Message:
+		if !messages {
+			return
+		}
+		title, body = "新消息: "+data.Title, data.Content
+	case balanceChange:
+		if !debits || data.Initial || data.Delta >= 0 {
+			return
+		}
+		title = fmt.Sprintf("余额扣减 %.2f", -data.Delta)
+		body = fmt.Sprintf("当前余额 %.2f", data.Balance)
+		if entry, err := fetchLatestBalanceLog(); err != nil {
+			log.Printf("获取余额日志失败: %v", err)
+		} else if entry != nil && entry.BalanceAfter == data.Balance && entry.Description != "" {
+			body += "\n" + entry.Description
+		}
+	case vipExpiring:
+		if !vip {
+			return
+		}
+		title = fmt.Sprintf("VIP将在 %d 天后到期", data.DaysLeft)
+		body = fmt.Sprintf("%s 到期时间 %s", data.Name, data.ExpireAt.Local().Format("2006-01-02 15:04"))
+		if data.AutoRenew {
+			body += "\n已开启自动续费"
+		}
+	case vipRenewal:
+		if !vip {
+			return
+		}
+		switch data.Status {
+		case renewalCreated:
+			title = "VIP自动续费已下单"
+			body = fmt.Sprintf("%s %d 天，%s 元", data.Name, data.Duration, formatAmount(data.Amount))
+		case renewalSkipped:
+			title, body = "VIP未自动续费", data.Reason
+		default:
+			title, body = "VIP自动续费失败", data.Reason
+		}
+	case ruleTrigger:
+		if !rules {
+			return
+		}
+		title = fmt.Sprintf("余额低于 %s 元", formatAmount(data.Below))
+		body = fmt.Sprintf("当前余额 %s 元（规则 %s）", formatAmount(data.Balance), data.Rule)
+		switch data.Outcome {
+		case ruleCreated:
+			body += fmt.Sprintf("\n已创建 %s 元充值订单 %s", formatAmount(data.Amount), data.OrderNo)
+		case ruleDryRun:
+			body += fmt.Sprintf("\n演练模式：将充值 %s 元", formatAmount(data.Amount))
+		case ruleCapped, ruleFailed:
+			body += "\n未充值: " + data.Reason
+		}
+	default:
+		return
+	}
+
+	if err := n.Notify(title, body); err != nil {
+		log.Printf("发送桌面通知失败: %v", err)
+	}
+}
+
+// fetchLatestBalanceLog fetches the newest balance log entry, or nil if
+// there is none
+func fetchLatestBalanceLog() (*BalanceLog, error) {
+	resp, err := makeJWTRequest("GET", "/api/auth/user-logs/balance?page=1&page_size=1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs BalanceLogsResponse
+	if err := json.Unmarshal(resp.Data, &logs); err != nil {
+		return nil, fmt.Errorf("解析余额日志失败: %v", err)
+	}
+	if len(logs.Logs) == 0 {
+		return nil, nil
+	}
+
+	return &logs.Logs[0], nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Payment order statuses
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderFailed    = "failed"
+	orderExpired   = "expired"
+	orderCancelled = "cancelled"
+)
+
+// orderStatuses are the statuses accepted by the status filter
+var orderStatuses = map[string]bool{
+	orderPending: true, orderPaid: true, orderFailed: true, orderExpired: true, orderCancelled: true,
+}
+
+// isPaidStatus reports whether a status means the order was paid. Some
+// payment channels report success or completed instead of paid.
+func isPaidStatus(status string) bool {
+	switch strings.ToLower(status) {
+	case orderPaid, "success", "completed":
+		return true
+	}
+	return false
+}
+
+// paymentOrderQuery validates the payment order list filters
+func paymentOrderQuery(r *http.Request) (url.Values, error) {
+	q := r.URL.Query()
+	out := url.Values{}
+	if err := pageQuery(q, out); err != nil {
+		return nil, err
+	}
+	if v := q.Get("status"); v != "" {
+		if !orderStatuses[v] {
+			return nil, newAPIError(http.StatusBadRequest, "status 必须是 pending、paid、failed、expired 或 cancelled")
+		}
+		out.Set("status", v)
+	}
+	return out, nil
+}
+
+// fetchAllPaymentOrders walks every payment order page
+func fetchAllPaymentOrders() ([]PaymentOrder, error) {
+	var orders []PaymentOrder
+	err := walkPages("/api/auth/user-logs/payment-orders", nil, func(data json.RawMessage) (int, int64, error) {
+		var page PaymentOrdersResponse
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, 0, err
+		}
+		orders = append(orders, page.Orders...)
+		return len(page.Orders), page.Total, nil
+	})
+	return orders, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Pagination limits for list endpoints
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+	dateLayout      = "2006-01-02"
+)
+
+// filterValuePattern restricts free-form filter values such as message type
+var filterValuePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// pageQuery validates page and page_size and copies them into out
+func pageQuery(q url.Values, out url.Values) error {
+	page, pageSize := 1, defaultPageSize
+
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return newAPIError(http.StatusBadRequest, "page 必须是大于 0 的整数")
+		}
+		page = n
+	}
+	if v := q.Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return newAPIError(http.StatusBadRequest, "page_size 必须在 1 到 %d 之间", maxPageSize)
+		}
+		pageSize = n
+	}
+
+	out.Set("page", strconv.Itoa(page))
+	out.Set("page_size", strconv.Itoa(pageSize))
+	return nil
+}
+
+// filterQuery validates an optional enum-like filter value
+func filterQuery(q url.Values, out url.Values, name string) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	if !filterValuePattern.MatchString(v) {
+		return newAPIError(http.StatusBadRequest, "%s 格式无效", name)
+	}
+	out.Set(name, v)
+	return nil
+}
+
+// boolQuery validates an optional true/false filter
+func boolQuery(q url.Values, out url.Values, name string) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "%s 必须是 true 或 false", name)
+	}
+	out.Set(name, strconv.FormatBool(b))
+	return nil
+}
+
+// dateRangeQuery validates optional start_date/end_date (YYYY-MM-DD)
+func dateRangeQuery(q url.Values, out url.Values) error {
+	var start, end time.Time
+	for _, name := range []string{"start_date", "end_date"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "%s 格式应为 YYYY-MM-DD", name)
+		}
+		if name == "start_date" {
+			start = t
+		} else {
+			end = t
+		}
+		out.Set(name, v)
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return newAPIError(http.StatusBadRequest, "end_date 不能早于 start_date")
+	}
+	return nil
+}
+
+// messageQuery validates the message list filters forwarded upstream
+func messageQuery(r *http.Request) (url.Values, error) {
+	q := r.URL.Query()
+	out := url.Values{}
+	if err := pageQuery(q, out); err != nil {
+		return nil, err
+	}
+	if err := filterQuery(q, out, "type"); err != nil {
+		return nil, err
+	}
+	if err := boolQuery(q, out, "is_read"); err != nil {
+		return nil, err
+	}
+	if err := dateRangeQuery(q, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// walkPages requests every page of a paginated JWT endpoint using the
+// largest page size. decode returns the number of items on the page and
+// the total reported upstream.
+func walkPages(endpoint string, query url.Values, decode func(data json.RawMessage) (n int, total int64, err error)) error {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("page_size", strconv.Itoa(maxPageSize))
+
+	var seen int64
+	for page := 1; ; page++ {
+		q.Set("page", strconv.Itoa(page))
+		resp, err := makeJWTRequest("GET", endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		n, total, err := decode(resp.Data)
+		if err != nil {
+			return newAPIError(http.StatusBadGateway, "解析响应失败: %v", err)
+		}
+
+		seen += int64(n)
+		if n == 0 || seen >= total {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settingsCacheTTL is how long fetched VIP levels and recharge settings
+// are reused for validation
+const settingsCacheTTL = time.Minute
+
+// Product types sent to /api/payment/create
+const (
+	productVIP      = "vip"
+	productRecharge = "recharge"
+)
+
+// RechargeRequest is the body of /api/jwt/recharge
+type RechargeRequest struct {
+	Amount        float64 `json:"amount"`
+	PaymentMethod string  `json:"payment_method"`
+	ProductType   string  `json:"product_type"` // Set by the demo
+}
+
+// VIPPurchaseRequest is the body of /api/jwt/purchase-vip
+type VIPPurchaseRequest struct {
+	ProductID     uint    `json:"product_id"` // VIPLevel.ID
+	Duration      int     `json:"duration"`   // Days, one of the level's plans
+	Amount        float64 `json:"amount"`     // Optional, must match the plan price
+	PaymentMethod string  `json:"payment_method"`
+	ProductType   string  `json:"product_type"` // Set by the demo
+}
+
+// liveValue caches a value fetched from the login service for
+// settingsCacheTTL
+type liveValue[T any] struct {
+	mu      sync.Mutex
+	value   T
+	fetched time.Time
+	fetch   func() (T, error)
+}
+
+// get returns the cached value, fetching it again once it is stale
+func (v *liveValue[T]) get() (T, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.fetched.IsZero() && time.Since(v.fetched) < settingsCacheTTL {
+		return v.value, nil
+	}
+	value, err := v.fetch()
+	if err != nil {
+		return value, err
+	}
+	v.value, v.fetched = value, time.Now()
+	return value, nil
+}
+
+var (
+	liveVIPLevels        = &liveValue[[]VIPLevel]{fetch: fetchVIPLevels}
+	liveRechargeSettings = &liveValue[*RechargeSettings]{fetch: fetchRechargeSettings}
+)
+
+// fetchPublicData fetches a public endpoint and returns its data
+func fetchPublicData(endpoint string) (json.RawMessage, error) {
+	resp, err := makePublicRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, newAPIError(resultStatus(resp), "API错误: %s", resp.Message)
+	}
+	return resp.Data, nil
+}
+
+// fetchVIPLevels fetches the purchasable VIP levels
+func fetchVIPLevels() ([]VIPLevel, error) {
+	data, err := fetchPublicData("/api/vip-levels")
+	if err != nil {
+		return nil, err
+	}
+
+	levels, err := parseVIPLevels(data)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadGateway, "解析VIP等级失败: %v", err)
+	}
+	return levels, nil
+}
+
+// parseVIPLevels decodes the /api/vip-levels data
+func parseVIPLevels(data json.RawMessage) ([]VIPLevel, error) {
+	var levels []VIPLevel
+	err := json.Unmarshal(data, &levels)
+	if err != nil {
+		// Some service versions wrap the list in {"levels": [...]}
+		var wrapped struct {
+			Levels []VIPLevel `json:"levels"`
+		}
+		if json.Unmarshal(data, &wrapped) != nil {
+			return nil, err
+		}
+		levels = wrapped.Levels
+	}
+	return levels, nil
+}
+
+// decodeVIPLevels is the Result decoder of /api/vip-levels
+func decodeVIPLevels(data json.RawMessage) (interface{}, error) {
+	return parseVIPLevels(data)
+}
+
+// fetchRechargeSettings fetches the recharge limits
+func fetchRechargeSettings() (*RechargeSettings, error) {
+	data, err := fetchPublicData("/api/recharge-settings")
+	if err != nil {
+		return nil, err
+	}
+
+	var settings RechargeSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, newAPIError(http.StatusBadGateway, "解析充值设置失败: %v", err)
+	}
+	return &settings, nil
+}
+
+// plans returns the purchasable durations of a level. Levels without
+// plans sell their single Duration at Price.
+func (l VIPLevel) plans() []VIPPlan {
+	if len(l.Plans) > 0 {
+		return l.Plans
+	}
+	if l.Duration > 0 {
+		return []VIPPlan{{Duration: l.Duration, Price: l.Price}}
+	}
+	return nil
+}
+
+// plan returns the plan with the given duration
+func (l VIPLevel) plan(days int) (VIPPlan, bool) {
+	for _, p := range l.plans() {
+		if p.Duration == days {
+			return p, true
+		}
+	}
+	return VIPPlan{}, false
+}
+
+// decodeStrictJSON decodes a request body, reporting unknown fields and
+// values of the wrong type per field
+func decodeStrictJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fieldErrors{typeErr.Field: "类型不正确，应为" + jsonKindName(typeErr.Type.Kind().String())}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fieldErrors{strings.Trim(name, `"`): "不支持的字段"}
+	}
+	return errInvalidBody
+}
+
+// jsonKindName describes a Go kind the way a JSON client sees it
+func jsonKindName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "数字"
+	case kind == "string":
+		return "字符串"
+	}
+	return kind
+}
+
+// joinAmounts formats amounts for error messages
+func joinAmounts(amounts []float64) string {
+	parts := make([]string, 0, len(amounts))
+	for _, a := range amounts {
+		parts = append(parts, formatAmount(a))
+	}
+	return strings.Join(parts, "、")
+}
+
+// hasCents reports whether v has more than two decimal places
+func hasCents(v float64) bool {
+	return math.Abs(v-round2(v)) > 1e-9
+}
+
+// checkPaymentMethod validates the payment method against the allowed
+// list, if the service provides one
+func checkPaymentMethod(errs fieldErrors, method string, allowed []string) {
+	if method == "" {
+		errs["payment_method"] = "请选择支付方式"
+		return
+	}
+	if len(allowed) == 0 {
+		return
+	}
+	for _, m := range allowed {
+		if m == method {
+			return
+		}
+	}
+	errs["payment_method"] = "支付方式必须是 " + strings.Join(allowed, "、") + " 之一"
+}
+
+// validate checks a recharge against the live settings
+func (req *RechargeRequest) validate(s *RechargeSettings) error {
+	errs := fieldErrors{}
+	switch {
+	case req.Amount <= 0:
+		errs["amount"] = "充值金额必须大于 0"
+	case hasCents(req.Amount):
+		errs["amount"] = "充值金额最多保留两位小数"
+	case req.Amount < s.MinAmount:
+		errs["amount"] = fmt.Sprintf("充值金额不能低于 %s 元", formatAmount(s.MinAmount))
+	case s.MaxAmount > 0 && req.Amount > s.MaxAmount:
+		errs["amount"] = fmt.Sprintf("充值金额不能高于 %s 元", formatAmount(s.MaxAmount))
+	case s.AllowCustom != nil && !*s.AllowCustom && !containsAmount(s.Presets, req.Amount):
+		errs["amount"] = "充值金额必须是 " + joinAmounts(s.Presets) + " 之一"
+	}
+	checkPaymentMethod(errs, req.PaymentMethod, s.PaymentMethods)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// containsAmount reports whether amounts contains v to the cent
+func containsAmount(amounts []float64, v float64) bool {
+	for _, a := range amounts {
+		if round2(a) == round2(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a VIP purchase against the live levels, filling in
+// the plan price when no amount was given
+func (req *VIPPurchaseRequest) validate(levels []VIPLevel) error {
+	errs := fieldErrors{}
+
+	var level *VIPLevel
+	for i := range levels {
+		if levels[i].ID == req.ProductID {
+			level = &levels[i]
+			break
+		}
+	}
+	switch {
+	case req.ProductID == 0:
+		errs["product_id"] = "请选择VIP等级"
+	case level == nil:
+		errs["product_id"] = "VIP等级不存在"
+	case req.Duration <= 0:
+		errs["duration"] = "时长必须大于 0 天"
+	default:
+		plan, ok := level.plan(req.Duration)
+		if !ok {
+			days := make([]string, 0, len(level.plans()))
+			for _, p := range level.plans() {
+				days = append(days, strconv.Itoa(p.Duration))
+			}
+			errs["duration"] = "可选时长为 " + strings.Join(days, "、") + " 天"
+			break
+		}
+		if req.Amount == 0 {
+			req.Amount = plan.Price
+		} else if round2(req.Amount) != round2(plan.Price) {
+			errs["amount"] = fmt.Sprintf("金额应为 %s 元", formatAmount(plan.Price))
+		}
+	}
+	checkPaymentMethod(errs, req.PaymentMethod, nil)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// rechargeBody decodes and validates a recharge before it is sent upstream
+func rechargeBody(r *http.Request) (interface{}, error) {
+	var req RechargeRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		return nil, err
+	}
+	settings, err := liveRechargeSettings.get()
+	if err != nil {
+		return nil, newAPIError(errorStatus(err), "获取充值设置失败: %v", err)
+	}
+	if err := req.validate(settings); err != nil {
+		return nil, err
+	}
+	req.ProductType = productRecharge
+	return req, nil
+}
+
+// vipPurchaseBody decodes and validates a VIP purchase before it is sent
+// upstream
+func vipPurchaseBody(r *http.Request) (interface{}, error) {
+	var req VIPPurchaseRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := checkVIPPurchase(&req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// checkVIPPurchase validates a VIP purchase against the live levels and
+// marks it as a VIP order
+func checkVIPPurchase(req *VIPPurchaseRequest) error {
+	levels, err := liveVIPLevels.get()
+	if err != nil {
+		return newAPIError(errorStatus(err), "获取VIP等级失败: %v", err)
+	}
+	if err := req.validate(levels); err != nil {
+		return err
+	}
+	req.ProductType = productVIP
+	return nil
+}
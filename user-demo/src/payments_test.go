@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// errorFields returns the sorted field names of a validation error
+func errorFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	fields, ok := err.(fieldErrors)
+	if !ok {
+		t.Fatalf("error %v is %T, want fieldErrors", err, err)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRechargeRequestValidate(t *testing.T) {
+	no := false
+	open := &RechargeSettings{MinAmount: 1, MaxAmount: 1000, PaymentMethods: []string{"alipay", "wechat"}}
+	presetsOnly := &RechargeSettings{MinAmount: 1, Presets: []float64{10, 50.5}, AllowCustom: &no}
+	unlimited := &RechargeSettings{}
+
+	tests := []struct {
+		name     string
+		req      RechargeRequest
+		settings *RechargeSettings
+		want     []string
+	}{
+		{"valid", RechargeRequest{Amount: 100, PaymentMethod: "alipay"}, open, nil},
+		{"minimum", RechargeRequest{Amount: 1, PaymentMethod: "alipay"}, open, nil},
+		{"maximum", RechargeRequest{Amount: 1000, PaymentMethod: "wechat"}, open, nil},
+		{"cents", RechargeRequest{Amount: 9.99, PaymentMethod: "alipay"}, open, nil},
+		{"zero", RechargeRequest{Amount: 0, PaymentMethod: "alipay"}, open, []string{"amount"}},
+		{"negative", RechargeRequest{Amount: -5, PaymentMethod: "alipay"}, open, []string{"amount"}},
+		{"fraction of a cent", RechargeRequest{Amount: 10.001, PaymentMethod: "alipay"}, open, []string{"amount"}},
+		{"below minimum", RechargeRequest{Amount: 0.5, PaymentMethod: "alipay"}, open, []string{"amount"}},
+		{"above maximum", RechargeRequest{Amount: 1000.01, PaymentMethod: "alipay"}, open, []string{"amount"}},
+		{"no maximum", RechargeRequest{Amount: 1e6, PaymentMethod: "card"}, unlimited, nil},
+		{"preset", RechargeRequest{Amount: 50.5, PaymentMethod: "alipay"}, presetsOnly, nil},
+		{"not a preset", RechargeRequest{Amount: 20, PaymentMethod: "alipay"}, presetsOnly, []string{"amount"}},
+		{"unknown payment method", RechargeRequest{Amount: 100, PaymentMethod: "balance"}, open, []string{"payment_method"}},
+		{"missing payment method", RechargeRequest{Amount: 100}, open, []string{"payment_method"}},
+		{"every field", RechargeRequest{Amount: -1, PaymentMethod: "cash"}, open, []string{"amount", "payment_method"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := errorFields(t, tt.req.validate(tt.settings))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("invalid fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVIPPurchaseRequestValidate(t *testing.T) {
+	levels := []VIPLevel{
+		{ID: 1, Level: 1, Name: "VIP 1", Plans: []VIPPlan{{Duration: 30, Price: 9.9}, {Duration: 90, Price: 25}}},
+		{ID: 2, Level: 2, Name: "VIP 2", Price: 19.9, Duration: 30},
+	}
+	tests := []struct {
+		name   string
+		req    VIPPurchaseRequest
+		want   []string
+		amount float64 // Amount after validation
+	}{
+		{"plan price filled in", VIPPurchaseRequest{ProductID: 1, Duration: 90, PaymentMethod: "alipay"}, nil, 25},
+		{"matching amount", VIPPurchaseRequest{ProductID: 1, Duration: 30, Amount: 9.9, PaymentMethod: "alipay"}, nil, 9.9},
+		{"single duration level", VIPPurchaseRequest{ProductID: 2, Duration: 30, PaymentMethod: "wechat"}, nil, 19.9},
+		{"wrong amount", VIPPurchaseRequest{ProductID: 1, Duration: 30, Amount: 1, PaymentMethod: "alipay"}, []string{"amount"}, 1},
+		{"missing level", VIPPurchaseRequest{Duration: 30, PaymentMethod: "alipay"}, []string{"product_id"}, 0},
+		{"unknown level", VIPPurchaseRequest{ProductID: 9, Duration: 30, PaymentMethod: "alipay"}, []string{"product_id"}, 0},
+		{"zero duration", VIPPurchaseRequest{ProductID: 1, PaymentMethod: "alipay"}, []string{"duration"}, 0},
+		{"duration not sold", VIPPurchaseRequest{ProductID: 2, Duration: 90, PaymentMethod: "alipay"}, []string{"duration"}, 0},
+		{"missing payment method", VIPPurchaseRequest{ProductID: 1, Duration: 30}, []string{"payment_method"}, 9.9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			got := errorFields(t, req.validate(levels))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("invalid fields = %v, want %v", got, tt.want)
+			}
+			if req.Amount != tt.amount {
+				t.Errorf("amount = %v, want %v", req.Amount, tt.amount)
+			}
+		})
+	}
+}
+
+func TestDecodeStrictJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string // Invalid fields, nil for success
+		bad  bool     // Rejected as an invalid body
+	}{
+		{"valid", `{"amount":10,"payment_method":"alipay"}`, nil, false},
+		{"unknown field", `{"amount":10,"coupon":"X"}`, []string{"coupon"}, false},
+		{"wrong type", `{"amount":"10"}`, []string{"amount"}, false},
+		{"not json", `amount=10`, nil, true},
+		{"empty", ``, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/jwt/recharge", strings.NewReader(tt.body))
+			var req RechargeRequest
+			err := decodeStrictJSON(r, &req)
+			if tt.bad {
+				if err != errInvalidBody {
+					t.Errorf("error = %v, want invalid body", err)
+				}
+				return
+			}
+			if got := errorFields(t, err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("invalid fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
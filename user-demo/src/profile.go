@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Register decoders for avatar uploads
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Profile field limits
+const (
+	maxDisplayNameLen = 32
+	maxAvatarURLLen   = 512
+)
+
+// Avatar upload limits
+const (
+	maxAvatarSize      = 2 << 20 // Bytes
+	minAvatarDimension = 32      // Pixels, each side
+	maxAvatarDimension = 4096
+	avatarFormField    = "avatar"
+)
+
+// avatarThumbnailSizes are the square thumbnails generated for an upload
+var avatarThumbnailSizes = []int{256, 64}
+
+// avatarTypes maps the accepted sniffed content types to file extensions
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+// ProfileUpdate is the body of /api/jwt/update-profile. Omitted fields
+// are left unchanged.
+type ProfileUpdate struct {
+	DisplayName *string `json:"display_name,omitempty"`
+	Avatar      *string `json:"avatar,omitempty"` // http(s) URL, empty clears it
+}
+
+// rawBody is an upstream request body sent as is instead of as JSON
+type rawBody struct {
+	ContentType string
+	Data        []byte
+}
+
+// validate trims and checks the fields that are set
+func (p *ProfileUpdate) validate() error {
+	if p.DisplayName == nil && p.Avatar == nil {
+		return newAPIError(http.StatusBadRequest, "请至少提供 display_name 或 avatar")
+	}
+	errs := fieldErrors{}
+
+	if p.DisplayName != nil {
+		name := strings.TrimSpace(*p.DisplayName)
+		p.DisplayName = &name
+		switch {
+		case name == "":
+			errs["display_name"] = "显示名称不能为空"
+		case utf8.RuneCountInString(name) > maxDisplayNameLen:
+			errs["display_name"] = fmt.Sprintf("显示名称最多 %d 个字符", maxDisplayNameLen)
+		case strings.IndexFunc(name, unicode.IsControl) >= 0:
+			errs["display_name"] = "显示名称不能包含控制字符"
+		}
+	}
+
+	if p.Avatar != nil {
+		avatar := strings.TrimSpace(*p.Avatar)
+		p.Avatar = &avatar
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			switch {
+			case len(avatar) > maxAvatarURLLen:
+				errs["avatar"] = fmt.Sprintf("头像地址最多 %d 个字符", maxAvatarURLLen)
+			case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+				errs["avatar"] = "头像必须是 http 或 https 地址"
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// profileUpdateBody decodes and validates a profile update before it is
+// sent upstream
+func profileUpdateBody(r *http.Request) (interface{}, error) {
+	var update ProfileUpdate
+	if err := decodeStrictJSON(r, &update); err != nil {
+		return nil, err
+	}
+	if err := update.validate(); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// readAvatar reads the uploaded avatar file, enforcing the size limit
+func readAvatar(r *http.Request) (data []byte, filename string, err error) {
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(nil, r.Body, maxAvatarSize+64*1024)
+	file, header, err := r.FormFile(avatarFormField)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, "", fieldErrors{avatarFormField: fmt.Sprintf("头像不能超过 %d MB", maxAvatarSize>>20)}
+	case err != nil:
+		return nil, "", fieldErrors{avatarFormField: "请选择头像文件"}
+	}
+	defer file.Close()
+
+	data, err = io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil {
+		return nil, "", errInvalidBody
+	}
+	if len(data) > maxAvatarSize {
+		return nil, "", fieldErrors{avatarFormField: fmt.Sprintf("头像不能超过 %d MB", maxAvatarSize>>20)}
+	}
+	return data, header.Filename, nil
+}
+
+// decodeAvatar checks the sniffed type and dimensions before decoding
+// the whole image
+func decodeAvatar(data []byte) (image.Image, string, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := avatarTypes[contentType]; !ok {
+		return nil, "", fieldErrors{avatarFormField: "头像必须是 PNG、JPEG 或 GIF 图片"}
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fieldErrors{avatarFormField: "无法解析图片"}
+	}
+	switch {
+	case cfg.Width < minAvatarDimension || cfg.Height < minAvatarDimension:
+		return nil, "", fieldErrors{avatarFormField: fmt.Sprintf("头像至少需要 %d×%d 像素", minAvatarDimension, minAvatarDimension)}
+	case cfg.Width > maxAvatarDimension || cfg.Height > maxAvatarDimension:
+		return nil, "", fieldErrors{avatarFormField: fmt.Sprintf("头像不能超过 %d×%d 像素", maxAvatarDimension, maxAvatarDimension)}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fieldErrors{avatarFormField: "无法解析图片"}
+	}
+	return img, contentType, nil
+}
+
+// thumbnail crops the centre square of src and scales it down to size
+// pixels by averaging, never scaling up
+func thumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	size = min(size, side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// addFilePart writes a file part to a multipart body
+func addFilePart(w *multipart.Writer, field, filename, contentType string, data []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, filename))
+	h.Set("Content-Type", contentType)
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	return err
+}
+
+// avatarUploadBody validates an uploaded avatar and builds the upstream
+// multipart body: the original file as "avatar" plus PNG thumbnails as
+// "thumbnail_<size>"
+func avatarUploadBody(r *http.Request) (interface{}, error) {
+	data, filename, err := readAvatar(r)
+	if err != nil {
+		return nil, err
+	}
+	img, contentType, err := decodeAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Name the file after its actual type, whatever the client called it
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if base == "" || base == "." || base == string(filepath.Separator) {
+		base = "avatar"
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := addFilePart(mw, avatarFormField, base+avatarTypes[contentType], contentType, data); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "生成上传内容失败: %v", err)
+	}
+	for _, size := range avatarThumbnailSizes {
+		var thumb bytes.Buffer
+		if err := png.Encode(&thumb, thumbnail(img, size)); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "生成缩略图失败: %v", err)
+		}
+		field := fmt.Sprintf("thumbnail_%d", size)
+		if err := addFilePart(mw, field, fmt.Sprintf("%s_%d.png", base, size), "image/png", thumb.Bytes()); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "生成上传内容失败: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "生成上传内容失败: %v", err)
+	}
+
+	return rawBody{ContentType: mw.FormDataContentType(), Data: buf.Bytes()}, nil
+}
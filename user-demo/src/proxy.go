@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxBufferedBody is the largest request body read into memory for the
+// audit log and idempotent replays; larger bodies are rejected with 413
+const maxBufferedBody = 64 << 10
+
+// authMode selects how a proxied request authenticates upstream
+type authMode int
+
+const (
+	authPublic authMode = iota // No authentication
+	authAPIKey                 // X-User-API-Key and X-User-ID headers
+	authJWT                    // Bearer token from cachedToken
+)
+
+// responseMode selects the envelope a proxied response is returned in
+type responseMode int
+
+const (
+	respData        responseMode = iota // {success: true, data}
+	respMessageData                     // {success: true, message, data}
+	respMessage                         // {success: true, message}
+	respPassthrough                     // {success, message, data} as returned upstream
+)
+
+// proxyRoute declares an endpoint that forwards to the login service
+type proxyRoute struct {
+	Method   string // Inbound method
+	Path     string // Inbound path, may contain {name} wildcards
+	Auth     authMode
+	Upstream string // Upstream method and path, e.g. "GET /api/auth/profile/{id}"
+
+	// Validate checks path values before anything is sent upstream
+	Validate func(r *http.Request) error
+
+	// Query validates the inbound query and returns the parameters
+	// appended to the upstream path. Nil forwards no query parameters.
+	Query func(r *http.Request) (url.Values, error)
+
+	// Body decodes the inbound request body into the value sent upstream.
+	// Nil means no body is forwarded. API key routes never send a body.
+	Body func(r *http.Request) (interface{}, error)
+
+	// Result decodes the upstream data into a typed value. Nil returns
+	// the raw data. With LenientResult a decode failure also falls back
+	// to the raw data instead of failing the request.
+	Result        func(data json.RawMessage) (interface{}, error)
+	LenientResult bool
+
+	Response responseMode
+
+	// Offline serves the route from the local history store when the
+	// login service is unavailable. The response is marked offline.
+	Offline func(r *http.Request, query url.Values) (interface{}, error)
+
+	// After runs once the upstream call succeeded, before responding
+	After func(r *http.Request, resp *APIResponse, result interface{})
+
+	// Idempotent routes run once per Idempotency-Key and forward the key
+	// upstream; see serveIdempotent
+	Idempotent bool
+
+	// Audit names the action recorded in the audit log for every
+	// request, including rejected ones. Empty means not audited.
+	Audit string
+}
+
+// decodeBody decodes the JSON request body into a T
+func decodeBody[T any](r *http.Request) (interface{}, error) {
+	var body T
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errInvalidBody
+	}
+	return body, nil
+}
+
+// validID checks that the named path value is a positive integer ID
+func validID(name string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		if id, err := strconv.ParseUint(r.PathValue(name), 10, 64); err != nil || id == 0 {
+			return newAPIError(http.StatusBadRequest, "%s 必须是正整数", name)
+		}
+		return nil
+	}
+}
+
+// decodeAs decodes upstream data into a T
+func decodeAs[T any](data json.RawMessage) (interface{}, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// upstreamPath expands {name} wildcards in the upstream path from the
+// inbound path values
+func (rt *proxyRoute) upstreamPath(r *http.Request) (method, path string) {
+	method, path, _ = strings.Cut(rt.Upstream, " ")
+	for {
+		start := strings.Index(path, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(path[start:], "}")
+		if end < 0 {
+			break
+		}
+		name := path[start+1 : start+end]
+		path = path[:start] + url.PathEscape(r.PathValue(name)) + path[start+end+1:]
+	}
+	return method, path
+}
+
+// call performs the upstream request for the route
+func (rt *proxyRoute) call(r *http.Request, query url.Values, body interface{}) (*APIResponse, error) {
+	method, path := rt.upstreamPath(r)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	switch rt.Auth {
+	case authAPIKey:
+		return makeAPIRequest(method, path)
+	case authJWT:
+		var header http.Header
+		if rt.Idempotent {
+			header = http.Header{idempotencyKeyHeader: {r.Header.Get(idempotencyKeyHeader)}}
+		}
+		return makeJWTRequestWithHeader(method, path, body, header)
+	}
+
+	resp, err := makePublicRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success && rt.Response != respPassthrough {
+		return nil, newAPIError(resultStatus(resp), "API错误: %s", resp.Message)
+	}
+	return resp, nil
+}
+
+// ServeHTTP checks auth, forwards the request and writes the envelope
+func (rt *proxyRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if rt.Audit != "" {
+		serveAudited(w, r, rt.Audit, rt.authorize)
+		return
+	}
+	rt.authorize(w, r)
+}
+
+// authorize checks the session before serving the request
+func (rt *proxyRoute) authorize(w http.ResponseWriter, r *http.Request) {
+	if rt.Auth == authJWT && getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	if rt.Idempotent {
+		serveIdempotent(w, r, rt.serve)
+		return
+	}
+	rt.serve(w, r)
+}
+
+// serve validates the request, calls upstream and writes the envelope
+func (rt *proxyRoute) serve(w http.ResponseWriter, r *http.Request) {
+	if rt.Validate != nil {
+		if err := rt.Validate(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	var query url.Values
+	if rt.Query != nil {
+		var err error
+		if query, err = rt.Query(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	var body interface{}
+	if rt.Body != nil {
+		var err error
+		if body, err = rt.Body(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	resp, err := rt.call(r, query, body)
+	if err != nil {
+		if rt.Offline != nil && localStore != nil && upstreamUnavailable(err) {
+			if data, offlineErr := rt.Offline(r, query); offlineErr == nil {
+				writeJSON(w, http.StatusOK, map[string]interface{}{
+					"success": true,
+					"data":    data,
+					"offline": true,
+				})
+				return
+			}
+		}
+		writeError(w, err)
+		return
+	}
+
+	var result interface{} = json.RawMessage(resp.Data)
+	if rt.Result != nil {
+		typed, err := rt.Result(resp.Data)
+		if err == nil {
+			result = typed
+		} else if !rt.LenientResult {
+			writeError(w, newAPIError(http.StatusBadGateway, "解析响应失败: %v", err))
+			return
+		}
+	}
+
+	if rt.After != nil {
+		rt.After(r, resp, result)
+	}
+
+	switch rt.Response {
+	case respMessageData:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"message": resp.Message,
+			"data":    result,
+		})
+	case respMessage:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"message": resp.Message,
+		})
+	case respPassthrough:
+		writeJSON(w, resultStatus(resp), map[string]interface{}{
+			"success": resp.Success,
+			"message": resp.Message,
+			"data":    result,
+		})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"data":    result,
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reconciliation issue kinds
+const (
+	issueDuplicateID    = "duplicate_id"    // The same log ID was returned more than once
+	issueMissingEntries = "missing_entries" // Fewer unique entries than the upstream total
+	issueGap            = "gap"             // Balance moved between two entries without a log entry
+	issueArithmetic     = "arithmetic"      // BalanceAfter disagrees with the previous balance plus Amount
+	issueFinalBalance   = "final_balance"   // The last BalanceAfter differs from the current balance
+	issueBalanceChanged = "balance_changed" // The balance changed while reconciling
+)
+
+// reconcileIssue is one inconsistency found in the balance log
+type reconcileIssue struct {
+	Kind       string  `json:"kind"`
+	LogID      uint    `json:"log_id,omitempty"`
+	PrevID     uint    `json:"prev_id,omitempty"`
+	Expected   float64 `json:"expected"`
+	Actual     float64 `json:"actual"`
+	Difference float64 `json:"difference"`
+	Message    string  `json:"message"`
+}
+
+// reconcileReport is the result of checking the whole balance log
+// against the current balance
+type reconcileReport struct {
+	GeneratedAt      time.Time        `json:"generated_at"`
+	ServerURL        string           `json:"server_url"`
+	UserID           uint             `json:"user_id"`
+	Entries          int              `json:"entries"`
+	UpstreamTotal    int64            `json:"upstream_total"`
+	FirstID          uint             `json:"first_id,omitempty"`
+	LastID           uint             `json:"last_id,omitempty"`
+	OpeningBalance   float64          `json:"opening_balance"`
+	LastBalanceAfter float64          `json:"last_balance_after"`
+	CurrentBalance   float64          `json:"current_balance"`
+	Consistent       bool             `json:"consistent"`
+	Issues           []reconcileIssue `json:"issues"`
+}
+
+// reconcileBalance fetches the whole balance log and the current balance
+// and checks that they agree
+func reconcileBalance() (*reconcileReport, error) {
+	before, err := fetchJWTBalance()
+	if err != nil {
+		return nil, err
+	}
+	logs, total, err := fetchAllBalanceLogs(logRange{})
+	if err != nil {
+		return nil, err
+	}
+	after, err := fetchJWTBalance()
+	if err != nil {
+		return nil, err
+	}
+
+	report := checkBalanceLogs(logs, total, after.Balance)
+	if math.Abs(after.Balance-before.Balance) > balanceEpsilon {
+		report.addIssue(reconcileIssue{
+			Kind:     issueBalanceChanged,
+			Expected: before.Balance,
+			Actual:   after.Balance,
+			Message:  "对账期间余额发生变化，请稍后重新对账",
+		})
+	}
+	report.Consistent = len(report.Issues) == 0
+	return report, nil
+}
+
+// addIssue records an issue with its difference filled in
+func (rep *reconcileReport) addIssue(issue reconcileIssue) {
+	issue.Difference = round2(issue.Actual - issue.Expected)
+	rep.Issues = append(rep.Issues, issue)
+}
+
+// checkBalanceLogs checks the chain of entries, oldest first.
+//
+// Each entry should satisfy previous BalanceAfter + Amount = BalanceAfter.
+// When it does not, the next entry tells the two failures apart: if the
+// next entry continues from the computed balance, this entry's
+// BalanceAfter is an arithmetic error; otherwise the balance really
+// moved and a log entry is missing (a gap).
+func checkBalanceLogs(logs []BalanceLog, total int64, current float64) *reconcileReport {
+	cfg := currentConfig()
+	rep := &reconcileReport{
+		GeneratedAt:    time.Now(),
+		ServerURL:      cfg.ServerURL,
+		UserID:         cfg.UserID,
+		UpstreamTotal:  total,
+		CurrentBalance: current,
+		Issues:         []reconcileIssue{},
+	}
+
+	// Drop repeated IDs so they do not also show up as chain breaks
+	seen := make(map[uint]BalanceLog, len(logs))
+	chain := make([]BalanceLog, 0, len(logs))
+	for _, entry := range logs {
+		if first, ok := seen[entry.ID]; ok {
+			msg := fmt.Sprintf("记录 #%d 重复出现", entry.ID)
+			if first != entry {
+				msg += "，且内容不同"
+			}
+			rep.addIssue(reconcileIssue{Kind: issueDuplicateID, LogID: entry.ID, Expected: first.BalanceAfter, Actual: entry.BalanceAfter, Message: msg})
+			continue
+		}
+		seen[entry.ID] = entry
+		chain = append(chain, entry)
+	}
+
+	rep.Entries = len(chain)
+	if int64(len(chain)) < total {
+		rep.addIssue(reconcileIssue{
+			Kind:     issueMissingEntries,
+			Expected: float64(total),
+			Actual:   float64(len(chain)),
+			Message:  fmt.Sprintf("上游报告 %d 条记录，实际获取 %d 条", total, len(chain)),
+		})
+	}
+	if len(chain) == 0 {
+		if math.Abs(current) > balanceEpsilon {
+			rep.addIssue(reconcileIssue{Kind: issueFinalBalance, Actual: current, Message: "没有余额记录，但当前余额不为 0"})
+		}
+		rep.Consistent = len(rep.Issues) == 0
+		return rep
+	}
+
+	rep.FirstID = chain[0].ID
+	rep.LastID = chain[len(chain)-1].ID
+	rep.OpeningBalance = round2(chain[0].BalanceAfter - chain[0].Amount)
+
+	balance := chain[0].BalanceAfter
+	for i := 1; i < len(chain); i++ {
+		prev, entry := chain[i-1], chain[i]
+		expected := round2(balance + entry.Amount)
+		if math.Abs(expected-entry.BalanceAfter) <= balanceEpsilon {
+			balance = entry.BalanceAfter
+			continue
+		}
+
+		if i+1 < len(chain) && math.Abs(round2(chain[i+1].BalanceAfter-chain[i+1].Amount)-expected) <= balanceEpsilon {
+			rep.addIssue(reconcileIssue{
+				Kind: issueArithmetic, LogID: entry.ID, PrevID: prev.ID,
+				Expected: expected, Actual: entry.BalanceAfter,
+				Message: fmt.Sprintf("记录 #%d 的变动后余额应为 %s，记录为 %s", entry.ID, formatAmount(expected), formatAmount(entry.BalanceAfter)),
+			})
+			balance = expected
+			continue
+		}
+
+		rep.addIssue(reconcileIssue{
+			Kind: issueGap, LogID: entry.ID, PrevID: prev.ID,
+			Expected: expected, Actual: entry.BalanceAfter,
+			Message: fmt.Sprintf("记录 #%d 与 #%d 之间余额变动了 %s，但没有对应记录",
+				prev.ID, entry.ID, formatAmount(round2(entry.BalanceAfter-expected))),
+		})
+		balance = entry.BalanceAfter
+	}
+
+	rep.LastBalanceAfter = balance
+	if math.Abs(balance-current) > balanceEpsilon {
+		rep.addIssue(reconcileIssue{
+			Kind: issueFinalBalance, LogID: rep.LastID,
+			Expected: balance, Actual: current,
+			Message: fmt.Sprintf("最后一条记录后的余额为 %s，当前余额为 %s", formatAmount(balance), formatAmount(current)),
+		})
+	}
+	rep.Consistent = len(rep.Issues) == 0
+	return rep
+}
+
+// writeText writes the report as plain text for support tickets
+func (rep *reconcileReport) writeText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "余额对账报告\n")
+	fmt.Fprintf(&b, "生成时间: %s\n", rep.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "服务器: %s\n", rep.ServerURL)
+	fmt.Fprintf(&b, "用户ID: %d\n", rep.UserID)
+	fmt.Fprintf(&b, "记录数: %d（上游总数 %d）\n", rep.Entries, rep.UpstreamTotal)
+	if rep.Entries > 0 {
+		fmt.Fprintf(&b, "记录 ID: #%d - #%d\n", rep.FirstID, rep.LastID)
+	}
+	fmt.Fprintf(&b, "期初余额: %s\n", formatAmount(rep.OpeningBalance))
+	fmt.Fprintf(&b, "记录推算余额: %s\n", formatAmount(rep.LastBalanceAfter))
+	fmt.Fprintf(&b, "当前余额: %s\n", formatAmount(rep.CurrentBalance))
+
+	if rep.Consistent {
+		fmt.Fprintf(&b, "结果: 一致\n")
+	} else {
+		fmt.Fprintf(&b, "结果: 不一致，发现 %d 个问题\n\n", len(rep.Issues))
+		for i, issue := range rep.Issues {
+			fmt.Fprintf(&b, "%d. [%s] %s", i+1, issue.Kind, issue.Message)
+			// Counts and duplicates have no balance to compare
+			if issue.Kind != issueDuplicateID && issue.Kind != issueMissingEntries {
+				fmt.Fprintf(&b, "（期望 %s，实际 %s，差额 %s）", formatAmount(issue.Expected), formatAmount(issue.Actual), formatAmount(issue.Difference))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// handleJWTBalanceReconcile reconciles the balance log against the
+// current balance. format=text returns a plain text report.
+func handleJWTBalanceReconcile(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		writeError(w, newAPIError(http.StatusBadRequest, "format 必须是 json 或 text"))
+		return
+	}
+
+	report, err := reconcileBalance()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Walking every page may have used up the write timeout
+	writeTimeout := secondsOrDefault(currentConfig().WriteTimeout, defaultWriteTimeout)
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+			"balance-reconcile-"+report.GeneratedAt.Format("20060102-150405")+".txt"))
+		report.writeText(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    report,
+	})
+}
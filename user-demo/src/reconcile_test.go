@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// entry builds a balance log entry
+func entry(id uint, amount, after float64) BalanceLog {
+	return BalanceLog{ID: id, Type: "test", Amount: amount, BalanceAfter: after}
+}
+
+func TestCheckBalanceLogs(t *testing.T) {
+	type issue struct {
+		Kind          string
+		LogID, PrevID uint
+		Difference    float64
+	}
+	tests := []struct {
+		name    string
+		logs    []BalanceLog
+		total   int64
+		current float64
+		opening float64
+		last    float64
+		want    []issue
+	}{
+		{
+			name:    "consistent",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 70), entry(3, -0.1, 69.9)},
+			total:   3,
+			current: 69.9,
+			opening: 0,
+			last:    69.9,
+			want:    []issue{},
+		},
+		{
+			name:    "opening balance before the first entry",
+			logs:    []BalanceLog{entry(7, -20, 80), entry(8, 10, 90)},
+			total:   2,
+			current: 90,
+			opening: 100,
+			last:    90,
+			want:    []issue{},
+		},
+		{
+			name:    "no entries and zero balance",
+			current: 0,
+			want:    []issue{},
+		},
+		{
+			name:    "no entries but a balance",
+			current: 5,
+			want:    []issue{{Kind: issueFinalBalance, Difference: 5}},
+		},
+		{
+			name:    "arithmetic error continues from the computed balance",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 75), entry(3, -10, 60)},
+			total:   3,
+			current: 60,
+			last:    60,
+			want:    []issue{{Kind: issueArithmetic, LogID: 2, PrevID: 1, Difference: 5}},
+		},
+		{
+			name:    "gap when the next entry continues from the recorded balance",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 50), entry(3, -10, 40)},
+			total:   3,
+			current: 40,
+			last:    40,
+			want:    []issue{{Kind: issueGap, LogID: 2, PrevID: 1, Difference: -20}},
+		},
+		{
+			name:    "gap on the last entry",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 60)},
+			total:   2,
+			current: 60,
+			last:    60,
+			want:    []issue{{Kind: issueGap, LogID: 2, PrevID: 1, Difference: -10}},
+		},
+		{
+			name:    "duplicate IDs are reported once and skipped",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 70), entry(2, -30, 70)},
+			total:   2,
+			current: 70,
+			last:    70,
+			want:    []issue{{Kind: issueDuplicateID, LogID: 2}},
+		},
+		{
+			name:    "missing entries",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 70)},
+			total:   5,
+			current: 70,
+			last:    70,
+			want:    []issue{{Kind: issueMissingEntries, Difference: -3}},
+		},
+		{
+			name:    "final balance differs",
+			logs:    []BalanceLog{entry(1, 100, 100), entry(2, -30, 70)},
+			total:   2,
+			current: 65.5,
+			last:    70,
+			want:    []issue{{Kind: issueFinalBalance, LogID: 2, Difference: -4.5}},
+		},
+		{
+			name:    "rounding within epsilon",
+			logs:    []BalanceLog{entry(1, 0.1, 0.1), entry(2, 0.2, 0.3)},
+			total:   2,
+			current: 0.3,
+			last:    0.3,
+			want:    []issue{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := checkBalanceLogs(tt.logs, tt.total, tt.current)
+			got := []issue{}
+			for _, i := range rep.Issues {
+				got = append(got, issue{Kind: i.Kind, LogID: i.LogID, PrevID: i.PrevID, Difference: i.Difference})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues = %+v, want %+v", got, tt.want)
+			}
+			if rep.Consistent != (len(tt.want) == 0) {
+				t.Errorf("consistent = %v with %d issues", rep.Consistent, len(tt.want))
+			}
+			if rep.OpeningBalance != tt.opening {
+				t.Errorf("opening balance = %v, want %v", rep.OpeningBalance, tt.opening)
+			}
+			if rep.LastBalanceAfter != tt.last {
+				t.Errorf("last balance = %v, want %v", rep.LastBalanceAfter, tt.last)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// proxyRoutes lists every endpoint forwarded to the login service
+var proxyRoutes = []*proxyRoute{
+	// API key authenticated endpoints
+	{
+		Method: "GET", Path: "/api/profile", Auth: authAPIKey,
+		Upstream: "GET /api/user-api/profile",
+		Result:   decodeAs[UserProfile],
+	},
+	{
+		Method: "GET", Path: "/api/balance", Auth: authAPIKey,
+		Upstream: "GET /api/user-api/balance",
+		Result:   decodeAs[UserBalance],
+	},
+	{
+		Method: "POST", Path: "/api/token", Auth: authAPIKey,
+		Upstream: "POST /api/user-api/token",
+		Result:   decodeAs[TokenResponse],
+		Audit:    auditTokenExchange,
+		// Cache the token for subsequent JWT requests
+		After: func(r *http.Request, resp *APIResponse, result interface{}) {
+			setCachedToken(result.(TokenResponse).AccessToken)
+		},
+	},
+
+	// JWT token authenticated endpoints
+	{
+		Method: "GET", Path: "/api/jwt/profile", Auth: authJWT,
+		Upstream: "GET /api/auth/profile",
+		Result:   decodeAs[UserProfile],
+	},
+	{
+		Method: "GET", Path: "/api/jwt/messages", Auth: authJWT,
+		Upstream: "GET /api/messages",
+		Query:    messageQuery,
+		Result:   decodeAs[MessagesResponse],
+		Offline:  offlineMessages,
+	},
+	{
+		Method: "GET", Path: "/api/jwt/messages/{id}", Auth: authJWT,
+		Upstream: "GET /api/messages/{id}",
+		Validate: validID("id"),
+		Result:   decodeAs[Message],
+		Offline:  offlineMessage,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/messages/{id}/read", Auth: authJWT,
+		Upstream: "POST /api/messages/{id}/read",
+		Validate: validID("id"),
+		Response: respMessageData,
+		After:    markCachedMessageRead,
+		Audit:    auditMessageRead,
+	},
+	{
+		Method: "DELETE", Path: "/api/jwt/messages/{id}", Auth: authJWT,
+		Upstream: "DELETE /api/messages/{id}",
+		Validate: validID("id"),
+		Response: respMessage,
+		After:    dropCachedMessage,
+		Audit:    auditMessageDelete,
+	},
+	{
+		Method: "GET", Path: "/api/jwt/unread-count", Auth: authJWT,
+		Upstream: "GET /api/messages/unread-count",
+		Result:   decodeAs[UnreadCountResponse],
+	},
+	{
+		Method: "GET", Path: "/api/jwt/balance-logs", Auth: authJWT,
+		Upstream: "GET /api/auth/user-logs/balance?page=1&page_size=10",
+		Result:   decodeAs[BalanceLogsResponse],
+		// Return raw data if parsing fails
+		LenientResult: true,
+		Offline:       offlineFirstPage(bucketBalanceLogs, "logs"),
+	},
+	{
+		Method: "POST", Path: "/api/jwt/update-profile", Auth: authJWT,
+		Upstream: "PUT /api/auth/profile",
+		Body:     profileUpdateBody,
+		Response: respMessageData,
+		Audit:    auditProfileUpdate,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/avatar", Auth: authJWT,
+		Upstream: "POST /api/auth/avatar",
+		Body:     avatarUploadBody,
+		Response: respMessageData,
+		Audit:    auditAvatarUpload,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/email/resend-verification", Auth: authJWT,
+		Upstream:      "POST /api/auth/email/resend-verification",
+		Result:        decodeAs[VerificationEmailSent],
+		LenientResult: true,
+		Response:      respMessageData,
+		Audit:         auditEmailResend,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/email/verify", Auth: authJWT,
+		Upstream:      "POST /api/auth/email/verify",
+		Body:          verifyEmailBody,
+		Result:        decodeAs[EmailVerification],
+		LenientResult: true,
+		Response:      respMessageData,
+		Audit:         auditEmailVerify,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/change-password", Auth: authJWT,
+		Upstream:      "POST /api/auth/change-password",
+		Body:          changePasswordBody,
+		Result:        decodeAs[PasswordChange],
+		LenientResult: true,
+		Response:      respMessage,
+		Audit:         auditPasswordChange,
+		// Keep the session alive if older tokens were revoked
+		After: cacheChangedPasswordToken,
+	},
+	{
+		Method: "GET", Path: "/api/jwt/balance", Auth: authJWT,
+		Upstream: "GET /api/auth/balance",
+	},
+	{
+		Method: "GET", Path: "/api/jwt/third-party-status", Auth: authJWT,
+		Upstream: "GET /api/auth/third-party-status",
+	},
+	{
+		Method: "GET", Path: "/api/jwt/payment-orders", Auth: authJWT,
+		Upstream: "GET /api/auth/user-logs/payment-orders",
+		Query:    paymentOrderQuery,
+		Result:   decodeAs[PaymentOrdersResponse],
+		Offline:  offlinePaymentOrders,
+	},
+	{
+		Method: "GET", Path: "/api/jwt/payment-orders/{id}", Auth: authJWT,
+		Upstream: "GET /api/auth/user-logs/payment-orders/{id}",
+		Validate: validID("id"),
+		Result:   decodeAs[PaymentOrder],
+		Offline:  offlinePaymentOrder,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/read-all-messages", Auth: authJWT,
+		Upstream: "POST /api/messages/read-all",
+		Response: respMessage,
+		After:    markAllCachedMessagesRead,
+		Audit:    auditMessagesReadAll,
+	},
+
+	// Username/password login with captcha
+	{
+		Method: "GET", Path: "/api/captcha/status", Auth: authPublic,
+		Upstream: "GET /api/captcha/status",
+	},
+	{
+		Method: "POST", Path: "/api/captcha/generate", Auth: authPublic,
+		Upstream: "POST /api/captcha/generate",
+	},
+	{
+		Method: "POST", Path: "/api/captcha/verify", Auth: authPublic,
+		Upstream: "POST /api/captcha/verify",
+		Body:     decodeBody[map[string]interface{}],
+		Response: respPassthrough,
+	},
+	{
+		Method: "POST", Path: "/api/login", Auth: authPublic,
+		Upstream: "POST /api/auth/login",
+		Body:     decodeBody[map[string]interface{}],
+		Response: respPassthrough,
+		After:    cacheSessionToken,
+		Audit:    auditLogin,
+	},
+
+	// Password reset, captcha checked the same way as login
+	{
+		Method: "POST", Path: "/api/password/forgot", Auth: authPublic,
+		Upstream:      "POST /api/auth/forgot-password",
+		Body:          passwordResetBody,
+		Result:        decodeAs[PasswordResetSent],
+		LenientResult: true,
+		Response:      respMessageData,
+		Audit:         auditPasswordForgot,
+	},
+
+	// Registration
+	{
+		Method: "POST", Path: "/api/register", Auth: authPublic,
+		Upstream: "POST /api/auth/register",
+		Body:     decodeBody[map[string]interface{}],
+		Response: respPassthrough,
+		After:    cacheSessionToken,
+		Audit:    auditRegister,
+	},
+
+	// VIP and Recharge related endpoints (public API)
+	{
+		Method: "GET", Path: "/api/vip-levels", Auth: authPublic,
+		Upstream: "GET /api/vip-levels",
+		Result:   decodeVIPLevels,
+	},
+	{
+		Method: "GET", Path: "/api/recharge-settings", Auth: authPublic,
+		Upstream: "GET /api/recharge-settings",
+		Result:   decodeAs[RechargeSettings],
+	},
+
+	// VIP purchase and recharge (JWT authenticated)
+	{
+		Method: "POST", Path: "/api/jwt/purchase-vip", Auth: authJWT,
+		Upstream: "POST /api/payment/create",
+		Body:     vipPurchaseBody,
+		Response: respMessageData,
+		After:    trackCreatedOrder(productVIP),
+
+		Idempotent: true,
+		Audit:      auditVIPPurchase,
+	},
+	{
+		Method: "POST", Path: "/api/jwt/recharge", Auth: authJWT,
+		Upstream: "POST /api/payment/create",
+		Body:     rechargeBody,
+		Response: respMessageData,
+		After:    trackCreatedOrder(productRecharge),
+
+		Idempotent: true,
+		Audit:      auditRecharge,
+	},
+}
+
+// registerProxyRoutes registers every proxy route on the mux
+func registerProxyRoutes(mux *http.ServeMux) {
+	for _, route := range proxyRoutes {
+		mux.Handle(route.Method+" "+route.Path, route)
+	}
+}
+
+// cacheSessionToken caches the JWT token returned by login or registration
+func cacheSessionToken(r *http.Request, resp *APIResponse, result interface{}) {
+	if !resp.Success || resp.Data == nil {
+		return
+	}
+
+	var sessionResp struct {
+		Token string `json:"token"`
+		User  struct {
+			ID          uint   `json:"id"`
+			Username    string `json:"username"`
+			Email       string `json:"email"`
+			DisplayName string `json:"display_name"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(resp.Data, &sessionResp); err == nil && sessionResp.Token != "" {
+		setSession(sessionResp.Token, sessionResp.User.ID)
+	}
+}
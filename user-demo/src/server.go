@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Default server timeouts in seconds
+const (
+	defaultReadTimeout       = 15
+	defaultReadHeaderTimeout = 5
+	defaultWriteTimeout      = 45 // Must exceed the 30s upstream client timeout
+	defaultIdleTimeout       = 60
+	defaultShutdownTimeout   = 30
+)
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// serverClosing is closed when shutdown begins so long-lived streams can
+// end instead of holding up the drain
+var serverClosing = make(chan struct{})
+
+// onShutdown registers a function to run after the server has drained
+func onShutdown(fn func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// runShutdownHooks runs registered hooks in reverse registration order
+func runShutdownHooks() {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// secondsOrDefault converts a seconds value from config to a duration
+func secondsOrDefault(seconds, fallback int) time.Duration {
+	if seconds <= 0 {
+		seconds = fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// newServer creates the HTTP server with the configured timeouts
+func newServer(addr string, handler http.Handler) *http.Server {
+	cfg := currentConfig()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       secondsOrDefault(cfg.ReadTimeout, defaultReadTimeout),
+		ReadHeaderTimeout: secondsOrDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		WriteTimeout:      secondsOrDefault(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       secondsOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
+	}
+}
+
+// runServer serves until SIGINT/SIGTERM, then drains in-flight requests
+// and runs the shutdown hooks before returning. Servers with a TLSConfig
+// are served over HTTPS.
+func runServer(servers ...*http.Server) error {
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				serveErr <- srv.ListenAndServeTLS("", "")
+			} else {
+				serveErr <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var runErr error
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		runErr = err
+	case sig := <-stop:
+		log.Printf("收到信号 %v，正在关闭服务器...", sig)
+	}
+
+	close(serverClosing)
+
+	timeout := secondsOrDefault(currentConfig().ShutdownTimeout, defaultShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("警告: 等待请求完成超时: %v", err)
+			if runErr == nil {
+				runErr = err
+			}
+		}
+	}
+
+	runShutdownHooks()
+	log.Printf("服务器已关闭")
+	return runErr
+}
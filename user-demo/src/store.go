@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names inside each user bucket
+var (
+	bucketMessages      = []byte("messages")
+	bucketBalanceLogs   = []byte("balance_logs")
+	bucketPaymentOrders = []byte("payment_orders")
+	bucketMessageTerms  = []byte("message_terms") // Full-text index: term 0x00 id -> nil
+	bucketSyncState     = []byte("sync_state")    // Kind name -> syncState
+)
+
+// historyStore keeps a local copy of the account history in a bbolt
+// file. Records are stored as the raw upstream JSON keyed by big-endian
+// ID, in one bucket per user.
+type historyStore struct {
+	db *bolt.DB
+}
+
+// localStore is the history store, nil when caching is disabled
+var localStore *historyStore
+
+// historyRecord is the part of every history item used for keys and
+// high-water marks
+type historyRecord struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// syncState is the high-water mark of one history kind
+type syncState struct {
+	MaxID        uint      `json:"max_id"`
+	MaxCreatedAt time.Time `json:"max_created_at"`
+	SyncedAt     time.Time `json:"synced_at"`
+	Count        int       `json:"count"`
+}
+
+// covers reports whether a record is at or below the high-water mark
+func (st syncState) covers(rec historyRecord) bool {
+	return st.MaxID != 0 && rec.ID <= st.MaxID && !rec.CreatedAt.After(st.MaxCreatedAt)
+}
+
+// openHistoryStore opens or creates the store file
+func openHistoryStore(path string) (*historyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("打开本地缓存 %s 失败: %v", path, err)
+	}
+	return &historyStore{db: db}, nil
+}
+
+// Close closes the store file
+func (s *historyStore) Close() error {
+	return s.db.Close()
+}
+
+// idKey encodes an ID so keys sort numerically
+func idKey(id uint) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// cloneBytes copies a value out of a transaction, keeping nil as nil
+func cloneBytes(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+// userBucket returns the user's bucket, creating it in write transactions
+func userBucket(tx *bolt.Tx, userID uint) (*bolt.Bucket, error) {
+	name := []byte("user:" + strconv.FormatUint(uint64(userID), 10))
+	if !tx.Writable() {
+		return tx.Bucket(name), nil
+	}
+	return tx.CreateBucketIfNotExists(name)
+}
+
+// kindBucket returns a bucket inside the user's bucket, or nil if it does
+// not exist in a read transaction
+func kindBucket(tx *bolt.Tx, userID uint, name []byte) (*bolt.Bucket, error) {
+	user, err := userBucket(tx, userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if !tx.Writable() {
+		return user.Bucket(name), nil
+	}
+	return user.CreateBucketIfNotExists(name)
+}
+
+// put stores raw records, keeping the message index up to date
+func (s *historyStore) put(userID uint, bucket []byte, items []json.RawMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := kindBucket(tx, userID, bucket)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			var rec historyRecord
+			if err := json.Unmarshal(item, &rec); err != nil || rec.ID == 0 {
+				continue
+			}
+			key := idKey(rec.ID)
+			if bytes.Equal(bucket, bucketMessages) {
+				if err := reindexMessage(tx, userID, rec.ID, cloneBytes(b.Get(key)), item); err != nil {
+					return err
+				}
+			}
+			if err := b.Put(key, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// get returns a stored record, or nil if it is not cached
+func (s *historyStore) get(userID uint, bucket []byte, id uint) (json.RawMessage, error) {
+	var out json.RawMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := kindBucket(tx, userID, bucket)
+		if err != nil || b == nil {
+			return err
+		}
+		out = cloneBytes(b.Get(idKey(id)))
+		return nil
+	})
+	return out, err
+}
+
+// updateMessage rewrites a cached message. fn receives nil for a delete.
+func (s *historyStore) updateMessage(userID, id uint, fn func(msg *Message) *Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := kindBucket(tx, userID, bucketMessages)
+		if err != nil {
+			return err
+		}
+		key := idKey(id)
+		old := cloneBytes(b.Get(key))
+		if old == nil {
+			return nil
+		}
+		var msg Message
+		if err := json.Unmarshal(old, &msg); err != nil {
+			return err
+		}
+
+		updated := fn(&msg)
+		if updated == nil {
+			if err := reindexMessage(tx, userID, id, old, nil); err != nil {
+				return err
+			}
+			return b.Delete(key)
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		if err := reindexMessage(tx, userID, id, old, data); err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// scan calls fn for each record newest ID first until fn returns false.
+// item is only valid until fn returns.
+func (s *historyStore) scan(userID uint, bucket []byte, fn func(item json.RawMessage) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := kindBucket(tx, userID, bucket)
+		if err != nil || b == nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if !fn(v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// syncState returns the high-water mark of a kind
+func (s *historyStore) syncState(userID uint, kind string) (syncState, error) {
+	var st syncState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := kindBucket(tx, userID, bucketSyncState)
+		if err != nil || b == nil {
+			return err
+		}
+		if v := b.Get([]byte(kind)); v != nil {
+			return json.Unmarshal(v, &st)
+		}
+		return nil
+	})
+	return st, err
+}
+
+// setSyncState stores the high-water mark of a kind, counting the records
+func (s *historyStore) setSyncState(userID uint, kind string, bucket []byte, st syncState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		items, err := kindBucket(tx, userID, bucket)
+		if err != nil {
+			return err
+		}
+		st.Count = items.Stats().KeyN
+
+		b, err := kindBucket(tx, userID, bucketSyncState)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(kind), data)
+	})
+}
+
+// isCJK reports whether r is written without spaces between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// searchTerms splits text into index terms: lowercase letter/digit runs,
+// and single characters plus bigrams for CJK text
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		if term != "" && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	var word []rune
+	var prev rune
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			add(string(word))
+			word = word[:0]
+			add(string(r))
+			if prev != 0 {
+				add(string([]rune{prev, r}))
+			}
+			prev = r
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+			prev = 0
+		default:
+			add(string(word))
+			word = word[:0]
+			prev = 0
+		}
+	}
+	add(string(word))
+	return terms
+}
+
+// messageTerms returns the index terms of a raw message
+func messageTerms(data []byte) []string {
+	if data == nil {
+		return nil
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+	return searchTerms(msg.Title + " " + msg.Content)
+}
+
+// termKey is the index key of a term for a message
+func termKey(term string, id uint) []byte {
+	return append(append([]byte(term), 0), idKey(id)...)
+}
+
+// reindexMessage replaces the index entries of old with those of data
+func reindexMessage(tx *bolt.Tx, userID, id uint, old, data []byte) error {
+	index, err := kindBucket(tx, userID, bucketMessageTerms)
+	if err != nil {
+		return err
+	}
+	for _, term := range messageTerms(old) {
+		if err := index.Delete(termKey(term, id)); err != nil {
+			return err
+		}
+	}
+	for _, term := range messageTerms(data) {
+		if err := index.Put(termKey(term, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchMessages returns cached messages containing every query term
+// (terms match as prefixes), newest first
+func (s *historyStore) searchMessages(userID uint, query string, limit int) ([]Message, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []Message{}, nil
+	}
+
+	messages := []Message{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index, err := kindBucket(tx, userID, bucketMessageTerms)
+		if err != nil || index == nil {
+			return err
+		}
+
+		var matches map[uint]bool
+		for _, term := range terms {
+			ids := make(map[uint]bool)
+			prefix := []byte(term)
+			c := index.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := uint(binary.BigEndian.Uint64(k[len(k)-8:]))
+				if matches == nil || matches[id] {
+					ids[id] = true
+				}
+			}
+			matches = ids
+			if len(matches) == 0 {
+				return nil
+			}
+		}
+
+		ids := make([]uint, 0, len(matches))
+		for id := range matches {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+		if len(ids) > limit {
+			ids = ids[:limit]
+		}
+
+		b, err := kindBucket(tx, userID, bucketMessages)
+		if err != nil || b == nil {
+			return err
+		}
+		for _, id := range ids {
+			var msg Message
+			if v := b.Get(idKey(id)); v != nil && json.Unmarshal(v, &msg) == nil {
+				messages = append(messages, msg)
+			}
+		}
+		return nil
+	})
+	return messages, err
+}
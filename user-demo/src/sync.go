@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Local history sync settings
+const (
+	defaultHistoryFile = "history.db"
+	historySyncEvery   = 5 * time.Minute
+	defaultSearchLimit = 50
+)
+
+// historyKind describes one list endpoint mirrored into the store
+type historyKind struct {
+	Name     string // Sync state key
+	Endpoint string
+	ListKey  string // Field of the page holding the items
+	Bucket   []byte
+
+	// Settled reports whether a stored record can no longer change.
+	// Unsettled records are fetched again on every sync. Nil means
+	// records never change.
+	Settled func(item json.RawMessage) bool
+}
+
+var historyKinds = []historyKind{
+	{Name: "messages", Endpoint: "/api/messages", ListKey: "messages", Bucket: bucketMessages, Settled: messageSettled},
+	{Name: "balance_logs", Endpoint: "/api/auth/user-logs/balance", ListKey: "logs", Bucket: bucketBalanceLogs},
+	{Name: "payment_orders", Endpoint: "/api/auth/user-logs/payment-orders", ListKey: "orders", Bucket: bucketPaymentOrders, Settled: orderSettled},
+}
+
+// messageSettled reports whether a cached message is read. Unread ones
+// may be read elsewhere.
+func messageSettled(item json.RawMessage) bool {
+	var msg Message
+	return json.Unmarshal(item, &msg) == nil && msg.IsRead
+}
+
+// orderSettled reports whether a cached order reached a terminal status
+func orderSettled(item json.RawMessage) bool {
+	var order PaymentOrder
+	return json.Unmarshal(item, &order) == nil && isTerminalStatus(order.Status)
+}
+
+// syncResult reports the outcome of syncing one kind
+type syncResult struct {
+	syncState
+	Added   int    `json:"added"`
+	Updated int    `json:"updated"` // Stored records that changed upstream
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	historySyncMu sync.Mutex // Serialises syncs
+	historySyncCh = make(chan struct{}, 1)
+)
+
+// requestHistorySync asks the background syncer to run soon
+func requestHistorySync() {
+	select {
+	case historySyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// startHistorySync syncs the store periodically and on request until
+// the server shuts down
+func startHistorySync() {
+	go func() {
+		ticker := time.NewTicker(historySyncEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-serverClosing:
+				return
+			case <-ticker.C:
+			case <-historySyncCh:
+			}
+			if getCachedToken() != "" {
+				syncHistory()
+			}
+		}
+	}()
+}
+
+// syncHistory syncs every kind for the current session. The token and
+// user ID come from one snapshot so records never land in another
+// user's buckets after a session switch.
+func syncHistory() map[string]syncResult {
+	historySyncMu.Lock()
+	defer historySyncMu.Unlock()
+
+	results := make(map[string]syncResult, len(historyKinds))
+	token, userID := cachedSession()
+	if token == "" {
+		return results
+	}
+	for _, kind := range historyKinds {
+		st, added, updated, err := localStore.syncKind(token, userID, kind)
+		res := syncResult{syncState: st, Added: added, Updated: updated}
+		if err != nil {
+			res.Error = err.Error()
+			log.Printf("同步本地缓存失败 (%s): %v", kind.Name, err)
+		}
+		results[kind.Name] = res
+	}
+	return results
+}
+
+// syncKind stores the records newer than the high-water mark and
+// refreshes stored records that are not settled yet. Pages are newest
+// first, so the walk stops at the first page reaching records already
+// stored, or once it is past the oldest unsettled record. The mark only
+// advances once the walk completes, so an interrupted first sync is
+// resumed from the top next time.
+func (s *historyStore) syncKind(token string, userID uint, kind historyKind) (st syncState, added, updated int, err error) {
+	st, err = s.syncState(userID, kind.Name)
+	if err != nil {
+		return st, 0, 0, err
+	}
+	next := st
+
+	unsettled, oldest, err := s.unsettled(userID, kind)
+	if err != nil {
+		return st, 0, 0, err
+	}
+
+	q := url.Values{}
+	q.Set("page_size", strconv.Itoa(maxPageSize))
+	var seen int64
+	for page := 1; ; page++ {
+		q.Set("page", strconv.Itoa(page))
+		resp, err := makeTokenRequest(token, "GET", kind.Endpoint+"?"+q.Encode(), nil, nil)
+		if err != nil {
+			return st, added, updated, err
+		}
+
+		var body map[string]json.RawMessage
+		var items []json.RawMessage
+		var total int64
+		if err := json.Unmarshal(resp.Data, &body); err != nil {
+			return st, added, updated, fmt.Errorf("解析响应失败: %v", err)
+		}
+		if err := json.Unmarshal(body[kind.ListKey], &items); err != nil && body[kind.ListKey] != nil {
+			return st, added, updated, fmt.Errorf("解析响应失败: %v", err)
+		}
+		json.Unmarshal(body["total"], &total)
+
+		fresh := make([]json.RawMessage, 0, len(items))
+		changed := make([]json.RawMessage, 0)
+		reached, pastUnsettled := false, false
+		for _, item := range items {
+			var rec historyRecord
+			if err := json.Unmarshal(item, &rec); err != nil || rec.ID == 0 {
+				continue
+			}
+			if rec.CreatedAt.Before(oldest) {
+				pastUnsettled = true
+			}
+			if st.covers(rec) {
+				reached = true
+				if cached, ok := unsettled[rec.ID]; ok {
+					delete(unsettled, rec.ID)
+					if !bytes.Equal(cached, item) {
+						changed = append(changed, item)
+					}
+				}
+				continue
+			}
+			fresh = append(fresh, item)
+			next.MaxID = max(next.MaxID, rec.ID)
+			if rec.CreatedAt.After(next.MaxCreatedAt) {
+				next.MaxCreatedAt = rec.CreatedAt
+			}
+		}
+		if err := s.put(userID, kind.Bucket, append(fresh, changed...)); err != nil {
+			return st, added, updated, err
+		}
+		added += len(fresh)
+		updated += len(changed)
+
+		seen += int64(len(items))
+		done := reached && (len(unsettled) == 0 || pastUnsettled)
+		if done || len(items) == 0 || seen >= total {
+			break
+		}
+	}
+
+	next.SyncedAt = time.Now()
+	if err := s.setSyncState(userID, kind.Name, kind.Bucket, next); err != nil {
+		return st, added, updated, err
+	}
+	st, err = s.syncState(userID, kind.Name)
+	return st, added, updated, err
+}
+
+// unsettled returns the stored records of kind that may still change,
+// and the creation time of the oldest one
+func (s *historyStore) unsettled(userID uint, kind historyKind) (map[uint]json.RawMessage, time.Time, error) {
+	out := make(map[uint]json.RawMessage)
+	var oldest time.Time
+	if kind.Settled == nil {
+		return out, oldest, nil
+	}
+	err := s.scan(userID, kind.Bucket, func(item json.RawMessage) bool {
+		var rec historyRecord
+		if json.Unmarshal(item, &rec) != nil || kind.Settled(item) {
+			return true
+		}
+		out[rec.ID] = cloneBytes(item)
+		if oldest.IsZero() || rec.CreatedAt.Before(oldest) {
+			oldest = rec.CreatedAt
+		}
+		return true
+	})
+	return out, oldest, err
+}
+
+// errNoHistory is returned when the local store is disabled
+var errNoHistory = newAPIError(http.StatusServiceUnavailable, "本地缓存未启用，请在配置中设置 history_file")
+
+// handleJWTSyncStatus returns the high-water marks of the local store
+func handleJWTSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if localStore == nil {
+		writeError(w, errNoHistory)
+		return
+	}
+
+	status := make(map[string]syncState, len(historyKinds))
+	for _, kind := range historyKinds {
+		st, err := localStore.syncState(currentConfig().UserID, kind.Name)
+		if err != nil {
+			writeError(w, newAPIError(http.StatusInternalServerError, "读取本地缓存失败: %v", err))
+			return
+		}
+		status[kind.Name] = st
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    status,
+	})
+}
+
+// handleJWTSync syncs the local store now
+func handleJWTSync(w http.ResponseWriter, r *http.Request) {
+	if localStore == nil {
+		writeError(w, errNoHistory)
+		return
+	}
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    syncHistory(),
+	})
+}
+
+// handleJWTMessageSearch searches the titles and content of cached
+// messages. Query: q and limit (default 50).
+func handleJWTMessageSearch(w http.ResponseWriter, r *http.Request) {
+	if localStore == nil {
+		writeError(w, errNoHistory)
+		return
+	}
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	q := r.URL.Query()
+	query := q.Get("q")
+	if query == "" || len(query) > 200 {
+		writeError(w, newAPIError(http.StatusBadRequest, "q 不能为空且不超过 200 字节"))
+		return
+	}
+	limit := defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, newAPIError(http.StatusBadRequest, "limit 必须在 1 到 %d 之间", maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	messages, err := localStore.searchMessages(currentConfig().UserID, query, limit)
+	if err != nil {
+		writeError(w, newAPIError(http.StatusInternalServerError, "搜索本地缓存失败: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    messages,
+	})
+}
+
+// offlineMessages serves /api/jwt/messages from the store, applying the
+// validated filters and pagination
+func offlineMessages(r *http.Request, query url.Values) (interface{}, error) {
+	page, _ := strconv.Atoi(query.Get("page"))
+	pageSize, _ := strconv.Atoi(query.Get("page_size"))
+	skip := (page - 1) * pageSize
+
+	out := MessagesResponse{Messages: []Message{}, Page: page, PageSize: pageSize}
+	err := localStore.scan(currentConfig().UserID, bucketMessages, func(item json.RawMessage) bool {
+		var msg Message
+		if json.Unmarshal(item, &msg) != nil || !messageMatches(msg, query) {
+			return true
+		}
+		if out.Total >= int64(skip) && len(out.Messages) < pageSize {
+			out.Messages = append(out.Messages, msg)
+		}
+		out.Total++
+		return true
+	})
+	return out, err
+}
+
+// messageMatches applies the message list filters to a cached message
+func messageMatches(msg Message, query url.Values) bool {
+	if v := query.Get("type"); v != "" && msg.Type != v {
+		return false
+	}
+	if v := query.Get("is_read"); v != "" && strconv.FormatBool(msg.IsRead) != v {
+		return false
+	}
+	day := msg.CreatedAt.Format(dateLayout)
+	if v := query.Get("start_date"); v != "" && day < v {
+		return false
+	}
+	if v := query.Get("end_date"); v != "" && day > v {
+		return false
+	}
+	return true
+}
+
+// offlineMessage serves /api/jwt/messages/{id} from the store
+func offlineMessage(r *http.Request, query url.Values) (interface{}, error) {
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	data, err := localStore.get(currentConfig().UserID, bucketMessages, uint(id))
+	if err != nil || data == nil {
+		return nil, fmt.Errorf("本地缓存中没有消息 %d", id)
+	}
+	var msg Message
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// offlineFirstPage serves the first page of a cached list in the shape
+// of the upstream response
+func offlineFirstPage(bucket []byte, listKey string) func(r *http.Request, query url.Values) (interface{}, error) {
+	return func(r *http.Request, query url.Values) (interface{}, error) {
+		items := []json.RawMessage{}
+		total := 0
+		err := localStore.scan(currentConfig().UserID, bucket, func(item json.RawMessage) bool {
+			if len(items) < defaultPageSize {
+				items = append(items, cloneBytes(item))
+			}
+			total++
+			return true
+		})
+		return map[string]interface{}{
+			listKey:     items,
+			"total":     total,
+			"page":      1,
+			"page_size": defaultPageSize,
+		}, err
+	}
+}
+
+// offlinePaymentOrders serves /api/jwt/payment-orders from the store,
+// applying the status filter and pagination
+func offlinePaymentOrders(r *http.Request, query url.Values) (interface{}, error) {
+	page, _ := strconv.Atoi(query.Get("page"))
+	pageSize, _ := strconv.Atoi(query.Get("page_size"))
+	skip := (page - 1) * pageSize
+	status := query.Get("status")
+
+	out := PaymentOrdersResponse{Orders: []PaymentOrder{}, Page: page, PageSize: pageSize}
+	err := localStore.scan(currentConfig().UserID, bucketPaymentOrders, func(item json.RawMessage) bool {
+		var order PaymentOrder
+		if json.Unmarshal(item, &order) != nil || (status != "" && order.Status != status) {
+			return true
+		}
+		if out.Total >= int64(skip) && len(out.Orders) < pageSize {
+			out.Orders = append(out.Orders, order)
+		}
+		out.Total++
+		return true
+	})
+	return out, err
+}
+
+// offlinePaymentOrder serves /api/jwt/payment-orders/{id} from the store
+func offlinePaymentOrder(r *http.Request, query url.Values) (interface{}, error) {
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	data, err := localStore.get(currentConfig().UserID, bucketPaymentOrders, uint(id))
+	if err != nil || data == nil {
+		return nil, fmt.Errorf("本地缓存中没有订单 %d", id)
+	}
+	var order PaymentOrder
+	err = json.Unmarshal(data, &order)
+	return order, err
+}
+
+// markCachedMessageRead marks the cached copy of {id} read
+func markCachedMessageRead(r *http.Request, resp *APIResponse, result interface{}) {
+	if localStore == nil {
+		return
+	}
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	markCachedRead(uint(id))
+}
+
+// markCachedRead marks a cached message read
+func markCachedRead(id uint) {
+	now := time.Now()
+	err := localStore.updateMessage(currentConfig().UserID, id, func(msg *Message) *Message {
+		if !msg.IsRead {
+			msg.IsRead, msg.ReadAt = true, &now
+		}
+		return msg
+	})
+	if err != nil {
+		log.Printf("更新本地缓存失败: %v", err)
+	}
+}
+
+// markAllCachedMessagesRead marks every cached message read
+func markAllCachedMessagesRead(r *http.Request, resp *APIResponse, result interface{}) {
+	if localStore == nil {
+		return
+	}
+	var unread []uint
+	localStore.scan(currentConfig().UserID, bucketMessages, func(item json.RawMessage) bool {
+		var msg Message
+		if json.Unmarshal(item, &msg) == nil && !msg.IsRead {
+			unread = append(unread, msg.ID)
+		}
+		return true
+	})
+	for _, id := range unread {
+		markCachedRead(id)
+	}
+}
+
+// dropCachedMessage removes the cached copy of {id}
+func dropCachedMessage(r *http.Request, resp *APIResponse, result interface{}) {
+	if localStore == nil {
+		return
+	}
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	err := localStore.updateMessage(currentConfig().UserID, uint(id), func(msg *Message) *Message {
+		return nil
+	})
+	if err != nil {
+		log.Printf("更新本地缓存失败: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Order status polling. The interval doubles after each check that
+// leaves the order open; tracking stops after orderTrackTimeout.
+const (
+	minOrderPollInterval = 3 * time.Second
+	maxOrderPollInterval = 60 * time.Second
+	orderTrackTimeout    = 30 * time.Minute
+)
+
+// eventOrderUpdated is published when a tracked order changes status
+const eventOrderUpdated = "order.updated"
+
+// trackedOrder is an order created in this session and its last known
+// status. It is also the payload of order.updated.
+type trackedOrder struct {
+	ID          uint      `json:"id"`
+	OrderNo     string    `json:"order_no"`
+	ProductType string    `json:"product_type"`
+	Amount      float64   `json:"amount"`
+	Status      string    `json:"status"`
+	Done        bool      `json:"done"`                // Terminal status reached or tracking gave up
+	TimedOut    bool      `json:"timed_out,omitempty"` // Gave up before a terminal status
+	Checks      int       `json:"checks"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// orderTracker polls the orders created with the cached token. Orders
+// belong to the token they were created with and are dropped when the
+// session changes.
+type orderTracker struct {
+	mu     sync.Mutex
+	token  string
+	orders map[uint]*trackedOrder
+}
+
+var tracker = &orderTracker{orders: make(map[uint]*trackedOrder)}
+
+// isTerminalStatus reports whether an order status will not change again
+func isTerminalStatus(status string) bool {
+	switch status {
+	case orderFailed, orderExpired, orderCancelled:
+		return true
+	}
+	return isPaidStatus(status)
+}
+
+// trackCreatedOrder returns an After hook that starts tracking the order
+// returned by /api/payment/create
+func trackCreatedOrder(productType string) func(r *http.Request, resp *APIResponse, result interface{}) {
+	return func(r *http.Request, resp *APIResponse, result interface{}) {
+		if !resp.Success || resp.Data == nil {
+			return
+		}
+		if order, ok := createdOrder(resp.Data, productType); ok {
+			tracker.track(getCachedToken(), order)
+		}
+	}
+}
+
+// createdOrder decodes the order in a /api/payment/create response. The
+// order ID is id on the order itself or order_id alongside the payment
+// details.
+func createdOrder(data json.RawMessage, productType string) (PaymentOrder, bool) {
+	var created struct {
+		PaymentOrder
+		OrderID uint `json:"order_id"`
+	}
+	if err := json.Unmarshal(data, &created); err != nil {
+		log.Printf("解析创建的订单失败: %v", err)
+		return PaymentOrder{}, false
+	}
+	order := created.PaymentOrder
+	if order.ID == 0 {
+		order.ID = created.OrderID
+	}
+	if order.ID == 0 {
+		log.Printf("创建订单的响应中没有订单ID，无法跟踪支付状态")
+		return PaymentOrder{}, false
+	}
+	if order.ProductType == "" {
+		order.ProductType = productType
+	}
+	if order.Status == "" {
+		order.Status = orderPending
+	}
+	return order, true
+}
+
+// track records an order and polls it until it reaches a terminal status
+func (t *orderTracker) track(token string, order PaymentOrder) {
+	if token == "" {
+		return
+	}
+
+	now := time.Now()
+	o := &trackedOrder{
+		ID:          order.ID,
+		OrderNo:     order.OrderNo,
+		ProductType: order.ProductType,
+		Amount:      order.Amount,
+		Status:      order.Status,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	t.mu.Lock()
+	if t.token != token {
+		t.token = token
+		t.orders = make(map[uint]*trackedOrder)
+	}
+	if _, ok := t.orders[o.ID]; ok {
+		t.mu.Unlock()
+		return
+	}
+	t.orders[o.ID] = o
+	t.mu.Unlock()
+
+	events.publish(event{Type: eventOrderUpdated, Data: *o})
+	if isTerminalStatus(o.Status) {
+		t.finish(o.ID, o.Status, false)
+		return
+	}
+	go t.poll(token, o.ID)
+}
+
+// poll checks the order status with backoff until it is final, the
+// session changes, tracking times out or the server shuts down
+func (t *orderTracker) poll(token string, id uint) {
+	deadline := time.Now().Add(orderTrackTimeout)
+	interval := minOrderPollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-serverClosing:
+			return
+		case <-timer.C:
+		}
+		if getCachedToken() != token || t.done(id) {
+			return
+		}
+
+		order, err := fetchPaymentOrder(id)
+		switch {
+		case err != nil:
+			log.Printf("查询订单 %d 状态失败: %v", id, err)
+		case isTerminalStatus(order.Status):
+			t.finish(id, order.Status, false)
+			return
+		default:
+			t.update(id, order.Status)
+		}
+
+		if time.Now().After(deadline) {
+			log.Printf("订单 %d 在 %v 内未完成支付，停止跟踪", id, orderTrackTimeout)
+			t.finish(id, "", true)
+			return
+		}
+		interval = min(interval*2, maxOrderPollInterval)
+		timer.Reset(interval)
+	}
+}
+
+// update records a check of an open order, publishing status changes.
+// Finished orders are left alone.
+func (t *orderTracker) update(id uint, status string) {
+	t.mu.Lock()
+	o, ok := t.orders[id]
+	if !ok || o.Done {
+		t.mu.Unlock()
+		return
+	}
+	o.Checks++
+	changed := o.Status != status
+	if changed {
+		o.Status = status
+		o.UpdatedAt = time.Now()
+	}
+	snapshot := *o
+	t.mu.Unlock()
+
+	if changed {
+		events.publish(event{Type: eventOrderUpdated, Data: snapshot})
+	}
+}
+
+// finish marks an order done and publishes the outcome. A paid order
+// refreshes the account state so balance and VIP level update at once.
+func (t *orderTracker) finish(id uint, status string, timedOut bool) {
+	t.mu.Lock()
+	o, ok := t.orders[id]
+	if !ok || o.Done {
+		t.mu.Unlock()
+		return
+	}
+	if status != "" {
+		o.Status = status
+		o.Checks++
+	}
+	o.Done = true
+	o.TimedOut = timedOut
+	o.UpdatedAt = time.Now()
+	snapshot := *o
+	t.mu.Unlock()
+
+	events.publish(event{Type: eventOrderUpdated, Data: snapshot})
+	if isPaidStatus(snapshot.Status) {
+		log.Printf("订单 %s 已支付", snapshot.OrderNo)
+		events.refresh()
+		if localStore != nil {
+			requestHistorySync()
+		}
+	}
+}
+
+// done reports whether an order is no longer being polled
+func (t *orderTracker) done(id uint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.orders[id]
+	return !ok || o.Done
+}
+
+// notify applies a payment webhook. Tracked orders are updated in place;
+// other orders are announced once with the notified status.
+func (t *orderTracker) notify(n paymentNotification) {
+	t.mu.Lock()
+	_, tracked := t.orders[n.OrderID]
+	t.mu.Unlock()
+
+	switch {
+	case tracked && isTerminalStatus(n.Status):
+		t.finish(n.OrderID, n.Status, false)
+	case tracked:
+		t.update(n.OrderID, n.Status)
+	default:
+		now := time.Now()
+		events.publish(event{Type: eventOrderUpdated, Data: trackedOrder{
+			ID:          n.OrderID,
+			OrderNo:     n.OrderNo,
+			ProductType: n.ProductType,
+			Amount:      n.Amount,
+			Status:      n.Status,
+			Done:        isTerminalStatus(n.Status),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}})
+		if isPaidStatus(n.Status) {
+			events.refresh()
+		}
+	}
+}
+
+// list returns the orders tracked for the current session, newest first
+func (t *orderTracker) list() []trackedOrder {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	orders := []trackedOrder{}
+	if t.token == "" || t.token != getCachedToken() {
+		return orders
+	}
+	for _, o := range t.orders {
+		orders = append(orders, *o)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreatedAt.After(orders[j].CreatedAt) })
+	return orders
+}
+
+// fetchPaymentOrder fetches one payment order, refreshing the cached copy
+func fetchPaymentOrder(id uint) (*PaymentOrder, error) {
+	cfg := currentConfig()
+	resp, err := makeJWTRequest("GET", "/api/auth/user-logs/payment-orders/"+strconv.FormatUint(uint64(id), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var order PaymentOrder
+	if err := json.Unmarshal(resp.Data, &order); err != nil {
+		return nil, fmt.Errorf("解析订单失败: %v", err)
+	}
+
+	if localStore != nil && cfg.UserID != 0 {
+		if err := localStore.put(cfg.UserID, bucketPaymentOrders, []json.RawMessage{resp.Data}); err != nil {
+			log.Printf("缓存订单 %d 失败: %v", id, err)
+		}
+	}
+	return &order, nil
+}
+
+// handleJWTTrackedOrders lists the orders created in this session with
+// their last known status
+func handleJWTTrackedOrders(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    tracker.list(),
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestOrderTrackerNotify(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string // Notified in order
+		want     string
+		done     bool
+	}{
+		{"open update", []string{"processing"}, "processing", false},
+		{"terminal status finishes", []string{"processing", orderCancelled}, orderCancelled, true},
+		{"late pending after a terminal status", []string{orderFailed, orderPending}, orderFailed, true},
+		{"late open status after a terminal status", []string{orderExpired, "processing"}, orderExpired, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &orderTracker{token: "token", orders: map[uint]*trackedOrder{
+				1: {ID: 1, OrderNo: "PAY1", Status: orderPending},
+			}}
+			for _, status := range tt.statuses {
+				tr.notify(paymentNotification{OrderID: 1, OrderNo: "PAY1", Status: status})
+			}
+			o := tr.orders[1]
+			if o.Status != tt.want || o.Done != tt.done {
+				t.Errorf("order = %s done %v, want %s done %v", o.Status, o.Done, tt.want, tt.done)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PlanComparison is one VIP plan as seen from the user's account
+type PlanComparison struct {
+	LevelID     uint    `json:"level_id"`
+	Level       int     `json:"level"`
+	Name        string  `json:"name"`
+	Duration    int     `json:"duration"` // Days
+	Price       float64 `json:"price"`
+	PricePerDay float64 `json:"price_per_day"`
+	Relation    string  `json:"relation"`     // upgrade, renew or downgrade
+	Credit      float64 `json:"credit"`       // Value of the remaining days, upgrades only
+	Cost        float64 `json:"cost"`         // Price less the credit
+	Affordable  bool    `json:"affordable"`   // The balance covers Cost
+	Shortfall   float64 `json:"shortfall"`    // Amount to recharge first
+	BestPerDay  bool    `json:"best_per_day"` // Cheapest duration of its level
+}
+
+// VIPComparison compares every plan with the user's current VIP status
+type VIPComparison struct {
+	Balance       float64          `json:"balance"`
+	CurrentLevel  int              `json:"current_level"`
+	CurrentName   string           `json:"current_name"`
+	ExpireAt      *time.Time       `json:"expire_at"`
+	RemainingDays int              `json:"remaining_days"`
+	DailyValue    float64          `json:"daily_value"` // Per-day value of the current level used for credits
+	Plans         []PlanComparison `json:"plans"`
+}
+
+// Plan relations to the current level
+const (
+	relationUpgrade   = "upgrade"
+	relationRenew     = "renew"
+	relationDowngrade = "downgrade"
+)
+
+// remainingDays returns the whole days left until expireAt, counting a
+// started day as a full one
+func remainingDays(expireAt *time.Time, now time.Time) int {
+	if expireAt == nil || !expireAt.After(now) {
+		return 0
+	}
+	return int(math.Ceil(expireAt.Sub(now).Hours() / 24))
+}
+
+// lowestPerDay returns the cheapest per-day price of a level
+func lowestPerDay(level VIPLevel) float64 {
+	best := 0.0
+	for _, p := range level.plans() {
+		if p.Duration <= 0 {
+			continue
+		}
+		if perDay := p.Price / float64(p.Duration); best == 0 || perDay < best {
+			best = perDay
+		}
+	}
+	return best
+}
+
+// compareVIPPlans builds the comparison. Upgrading credits the remaining
+// days of the current level at its cheapest per-day price; renewing and
+// downgrading cost the full price.
+func compareVIPPlans(levels []VIPLevel, balance UserBalance, now time.Time) VIPComparison {
+	cmp := VIPComparison{
+		Balance:      balance.Balance,
+		CurrentLevel: balance.VIPLevel,
+		CurrentName:  balance.VIPName,
+		Plans:        []PlanComparison{},
+	}
+	dailyValue := 0.0
+	if balance.VIPLevel > 0 {
+		cmp.ExpireAt = balance.VIPExpireAt
+		cmp.RemainingDays = remainingDays(balance.VIPExpireAt, now)
+		for _, level := range levels {
+			if level.Level == balance.VIPLevel {
+				dailyValue = lowestPerDay(level)
+				break
+			}
+		}
+	}
+	cmp.DailyValue = round2(dailyValue)
+	credit := round2(dailyValue * float64(cmp.RemainingDays))
+
+	for _, level := range levels {
+		bestPerDay := lowestPerDay(level)
+		for _, p := range level.plans() {
+			if p.Duration <= 0 {
+				continue
+			}
+			pc := PlanComparison{
+				LevelID:     level.ID,
+				Level:       level.Level,
+				Name:        level.Name,
+				Duration:    p.Duration,
+				Price:       p.Price,
+				PricePerDay: round2(p.Price / float64(p.Duration)),
+				BestPerDay:  p.Price/float64(p.Duration) == bestPerDay,
+				Cost:        p.Price,
+			}
+			switch {
+			case level.Level > balance.VIPLevel:
+				pc.Relation = relationUpgrade
+				pc.Credit = math.Min(credit, p.Price)
+				pc.Cost = round2(p.Price - pc.Credit)
+			case level.Level == balance.VIPLevel:
+				pc.Relation = relationRenew
+			default:
+				pc.Relation = relationDowngrade
+			}
+			pc.Affordable = balance.Balance >= pc.Cost
+			if !pc.Affordable {
+				pc.Shortfall = round2(pc.Cost - balance.Balance)
+			}
+			cmp.Plans = append(cmp.Plans, pc)
+		}
+	}
+
+	sort.SliceStable(cmp.Plans, func(i, j int) bool {
+		a, b := cmp.Plans[i], cmp.Plans[j]
+		if a.Level != b.Level {
+			return a.Level < b.Level
+		}
+		return a.Duration < b.Duration
+	})
+	return cmp
+}
+
+// handleJWTVIPComparison compares the VIP plans with the user's current
+// level, expiry and balance
+func handleJWTVIPComparison(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	balance, err := fetchJWTBalance()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	levels, err := liveVIPLevels.get()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    compareVIPPlans(levels, *balance, time.Now()),
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// VIP expiry checks run hourly and when a session starts. Auto-renewal
+// happens once less than autoRenewLeadTime is left.
+const (
+	vipCheckInterval       = time.Hour
+	autoRenewLeadTime      = 24 * time.Hour
+	defaultVIPReminderDays = 7
+)
+
+// Event types published by the VIP scheduler
+const (
+	eventVIPExpiring = "vip.expiring"
+	eventVIPRenewal  = "vip.renewal"
+)
+
+// Auto-renewal outcomes
+const (
+	renewalCreated = "created"
+	renewalSkipped = "skipped"
+	renewalFailed  = "failed"
+)
+
+// AutoRenewSettings is the auto-renewal setting of one user
+type AutoRenewSettings struct {
+	Enabled       bool    `json:"enabled"`        // Order the current level again before it expires
+	MaxAmount     float64 `json:"max_amount"`     // Highest price a renewal may pay (0 = never pays)
+	Duration      int     `json:"duration"`       // Plan days to renew with (0 = shortest plan)
+	PaymentMethod string  `json:"payment_method"` // One of the live recharge settings' payment methods
+}
+
+// checkAutoRenewPaymentMethod checks a payment method against the live
+// recharge settings, the methods /api/payment/create accepts
+func checkAutoRenewPaymentMethod(method string) error {
+	settings, err := liveRechargeSettings.get()
+	if err != nil {
+		return newAPIError(errorStatus(err), "获取充值设置失败: %v", err)
+	}
+	errs := fieldErrors{}
+	checkPaymentMethod(errs, method, settings.PaymentMethods)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// autoRenewFor returns the auto-renewal setting of a user, disabled when
+// the user has none
+func (c *Config) autoRenewFor(userID uint) AutoRenewSettings {
+	return c.AutoRenew[userID]
+}
+
+// vipExpiring is the payload of vip.expiring
+type vipExpiring struct {
+	Level     int       `json:"level"`
+	Name      string    `json:"name"`
+	ExpireAt  time.Time `json:"expire_at"`
+	DaysLeft  int       `json:"days_left"`
+	AutoRenew bool      `json:"auto_renew"`
+}
+
+// vipRenewal is the payload of vip.renewal
+type vipRenewal struct {
+	Level    int       `json:"level"`
+	Name     string    `json:"name"`
+	Duration int       `json:"duration"`
+	Amount   float64   `json:"amount"`
+	Status   string    `json:"status"` // created, skipped or failed
+	Reason   string    `json:"reason,omitempty"`
+	OrderID  uint      `json:"order_id,omitempty"`
+	OrderNo  string    `json:"order_no,omitempty"`
+	ExpireAt time.Time `json:"expire_at"` // Expiry the renewal was for
+	At       time.Time `json:"at"`
+}
+
+// vipScheduler warns about an expiring VIP level and renews it when
+// auto-renewal is enabled. Warnings are per login session.
+type vipScheduler struct {
+	mu    sync.Mutex
+	token string
+
+	expiring      *vipExpiring // Last warning, nil when not expiring
+	remindedDays  int          // Days left at the last warning, so each day warns once
+	renewedExpiry time.Time    // Expiry an order was created for
+	lastRenewal   *vipRenewal
+}
+
+var (
+	vipReminders = &vipScheduler{}
+	vipCheckCh   = make(chan struct{}, 1)
+)
+
+// requestVIPCheck asks the scheduler to check the VIP expiry soon
+func requestVIPCheck() {
+	select {
+	case vipCheckCh <- struct{}{}:
+	default:
+	}
+}
+
+// startVIPScheduler checks the VIP expiry periodically and on request
+// until the server shuts down
+func startVIPScheduler() {
+	go func() {
+		ticker := time.NewTicker(vipCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-serverClosing:
+				return
+			case <-ticker.C:
+			case <-vipCheckCh:
+			}
+			if getCachedToken() != "" {
+				vipReminders.check(time.Now())
+			}
+		}
+	}()
+}
+
+// check warns once per remaining day inside the reminder window and
+// starts an auto-renewal when the level is about to lapse
+func (s *vipScheduler) check(now time.Time) {
+	// Decide with the balance of the session that would pay
+	token, userID := cachedSession()
+	if token == "" {
+		return
+	}
+	cfg := currentConfig()
+	renewal := cfg.autoRenewFor(userID)
+	balance, err := fetchTokenBalance(token)
+	if err != nil {
+		log.Printf("检查VIP到期时间失败: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.token != token {
+		// renewedExpiry survives logins so a new session cannot renew
+		// the same period again
+		s.token = token
+		s.expiring, s.remindedDays, s.lastRenewal = nil, 0, nil
+	}
+	if balance.VIPLevel == 0 || balance.VIPExpireAt == nil || !balance.VIPExpireAt.After(now) {
+		s.expiring = nil
+		s.mu.Unlock()
+		return
+	}
+	expireAt := *balance.VIPExpireAt
+	days := remainingDays(&expireAt, now)
+
+	var warning *vipExpiring
+	if cfg.VIPReminderDays > 0 && days <= cfg.VIPReminderDays {
+		if s.expiring == nil || !s.expiring.ExpireAt.Equal(expireAt) || days < s.remindedDays {
+			warning = &vipExpiring{
+				Level:     balance.VIPLevel,
+				Name:      balance.VIPName,
+				ExpireAt:  expireAt,
+				DaysLeft:  days,
+				AutoRenew: renewal.Enabled,
+			}
+			s.expiring, s.remindedDays = warning, days
+		}
+	} else {
+		s.expiring = nil
+	}
+	renew := renewal.Enabled && expireAt.Sub(now) <= autoRenewLeadTime && !s.renewedExpiry.Equal(expireAt)
+	s.mu.Unlock()
+
+	if warning != nil {
+		log.Printf("VIP将在 %d 天后到期（%s）", days, expireAt.Local().Format("2006-01-02 15:04"))
+		events.publish(event{Type: eventVIPExpiring, Data: *warning})
+	}
+	if renew {
+		s.renew(token, userID, renewal, balance, expireAt, now)
+	}
+}
+
+// renewalPlan picks the plan to renew with: the configured duration if
+// the level sells it, otherwise the shortest one
+func renewalPlan(level VIPLevel, days int) (VIPPlan, bool) {
+	if plan, ok := level.plan(days); ok {
+		return plan, true
+	}
+	plans := append([]VIPPlan(nil), level.plans()...)
+	if len(plans) == 0 {
+		return VIPPlan{}, false
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Duration < plans[j].Duration })
+	return plans[0], true
+}
+
+// renew orders the current level again through /api/payment/create with
+// the user's settings, validated like a manual purchase. The idempotency
+// key is derived from the expiry, so retries and restarts cannot buy
+// twice for the same period.
+func (s *vipScheduler) renew(token string, userID uint, settings AutoRenewSettings, balance *UserBalance, expireAt, now time.Time) {
+	result := vipRenewal{Level: balance.VIPLevel, Name: balance.VIPName, ExpireAt: expireAt, At: now}
+	defer func() {
+		s.mu.Lock()
+		repeated := s.lastRenewal != nil && s.lastRenewal.Status == result.Status &&
+			s.lastRenewal.Reason == result.Reason && s.lastRenewal.ExpireAt.Equal(expireAt)
+		if s.token == token {
+			s.lastRenewal = &result
+			if result.Status == renewalCreated {
+				s.renewedExpiry = expireAt
+			}
+		}
+		s.mu.Unlock()
+
+		// Skips and failures are retried hourly but only reported once
+		if !repeated {
+			log.Printf("VIP自动续费: %s %s", result.Status, result.Reason)
+			events.publish(event{Type: eventVIPRenewal, Data: result})
+		}
+	}()
+
+	levels, err := liveVIPLevels.get()
+	if err != nil {
+		result.Status, result.Reason = renewalFailed, fmt.Sprintf("获取VIP等级失败: %v", err)
+		return
+	}
+	var level *VIPLevel
+	for i := range levels {
+		if levels[i].Level == balance.VIPLevel {
+			level = &levels[i]
+			break
+		}
+	}
+	if level == nil {
+		result.Status, result.Reason = renewalSkipped, "当前VIP等级已不可购买"
+		return
+	}
+	plan, ok := renewalPlan(*level, settings.Duration)
+	if !ok {
+		result.Status, result.Reason = renewalSkipped, "当前VIP等级没有可购买的时长"
+		return
+	}
+	result.Name, result.Duration, result.Amount = level.Name, plan.Duration, plan.Price
+
+	if plan.Price > settings.MaxAmount {
+		result.Status = renewalSkipped
+		result.Reason = fmt.Sprintf("价格 %s 元超过自动续费上限 %s 元", formatAmount(plan.Price), formatAmount(settings.MaxAmount))
+		return
+	}
+
+	req := VIPPurchaseRequest{
+		ProductID:     level.ID,
+		Duration:      plan.Duration,
+		Amount:        plan.Price,
+		PaymentMethod: settings.PaymentMethod,
+	}
+	if err := checkVIPPurchase(&req); err != nil {
+		result.Status, result.Reason = renewalSkipped, err.Error()
+		return
+	}
+	if err := checkAutoRenewPaymentMethod(req.PaymentMethod); err != nil {
+		result.Status, result.Reason = renewalSkipped, err.Error()
+		return
+	}
+	key := fmt.Sprintf("vip-renew-%d-%d-%d", userID, level.ID, expireAt.Unix())
+	resp, err := makeTokenRequest(token, "POST", "/api/payment/create", req, http.Header{idempotencyKeyHeader: {key}})
+	summary := map[string]interface{}{"product_id": level.ID, "duration": plan.Duration, "amount": plan.Price, "idempotency_key": key}
+	if err != nil {
+		recordAudit("", sessionFingerprint(token), auditVIPAutoRenew, summary, errorStatus(err), false, err.Error())
+		result.Status, result.Reason = renewalFailed, err.Error()
+		return
+	}
+	recordAudit("", sessionFingerprint(token), auditVIPAutoRenew, summary, http.StatusOK, true, resp.Message)
+
+	result.Status = renewalCreated
+	if order, ok := createdOrder(resp.Data, productVIP); ok {
+		result.OrderID, result.OrderNo = order.ID, order.OrderNo
+		tracker.track(token, order)
+	}
+}
+
+// status returns the current warning and the last auto-renewal, with
+// the settings of the current user
+func (s *vipScheduler) status() map[string]interface{} {
+	cfg := currentConfig()
+	renewal := cfg.autoRenewFor(cfg.UserID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := map[string]interface{}{
+		"user_id":                   cfg.UserID,
+		"reminder_days":             cfg.VIPReminderDays,
+		"auto_renew":                renewal.Enabled,
+		"auto_renew_max_amount":     renewal.MaxAmount,
+		"auto_renew_duration":       renewal.Duration,
+		"auto_renew_payment_method": renewal.PaymentMethod,
+		"expiring":                  nil,
+		"last_renewal":              nil,
+	}
+	if s.token != getCachedToken() {
+		return out
+	}
+	if s.expiring != nil {
+		out["expiring"] = *s.expiring
+	}
+	if s.lastRenewal != nil {
+		out["last_renewal"] = *s.lastRenewal
+	}
+	return out
+}
+
+// handleJWTVIPStatus returns the expiry warning and auto-renewal state
+func handleJWTVIPStatus(w http.ResponseWriter, r *http.Request) {
+	if getCachedToken() == "" {
+		writeError(w, errNoToken)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"data":    vipReminders.status(),
+	})
+}
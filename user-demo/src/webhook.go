@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment webhook headers. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret, prefixed "sha256=".
+const (
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookSignaturePrefix = "sha256="
+)
+
+// Webhook limits
+const (
+	webhookPathPrefix   = "/webhooks/"
+	webhookMaxBody      = 64 << 10
+	webhookMaxClockSkew = 5 * time.Minute // Older timestamps are rejected as replays
+	webhookDedupeWindow = 24 * time.Hour
+)
+
+// paymentNotification is the body of a payment webhook
+type paymentNotification struct {
+	Event       string     `json:"event"`
+	OrderID     uint       `json:"order_id"`
+	OrderNo     string     `json:"order_no"`
+	ProductType string     `json:"product_type"`
+	Amount      float64    `json:"amount"`
+	Status      string     `json:"status"`
+	PaidAt      *time.Time `json:"paid_at"`
+}
+
+// paymentListener receives verified, deduplicated payment notifications
+type paymentListener func(n paymentNotification)
+
+var (
+	paymentListenersMu sync.Mutex
+	paymentListeners   []paymentListener
+)
+
+// onPaymentNotification registers a listener for payment notifications
+func onPaymentNotification(fn paymentListener) {
+	paymentListenersMu.Lock()
+	defer paymentListenersMu.Unlock()
+	paymentListeners = append(paymentListeners, fn)
+}
+
+// notifyPaymentListeners calls every listener in registration order
+func notifyPaymentListeners(n paymentNotification) {
+	paymentListenersMu.Lock()
+	listeners := paymentListeners
+	paymentListenersMu.Unlock()
+
+	for _, fn := range listeners {
+		fn(n)
+	}
+}
+
+// isWebhookPath reports whether a request targets a webhook. Webhooks
+// authenticate with their signature instead of the CSRF token and the
+// admin token.
+func isWebhookPath(path string) bool {
+	return strings.HasPrefix(path, webhookPathPrefix)
+}
+
+// signWebhook returns the signature header value for a webhook body
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks the timestamp and signature headers of a webhook
+func verifyWebhook(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp, err := strconv.ParseInt(header.Get(webhookTimestampHeader), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "缺少或无效的 %s", webhookTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > webhookMaxClockSkew || skew < -webhookMaxClockSkew {
+		return newAPIError(http.StatusUnauthorized, "时间戳超出允许范围")
+	}
+
+	expected := signWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(webhookSignatureHeader)), []byte(expected)) {
+		return newAPIError(http.StatusUnauthorized, "签名无效")
+	}
+	return nil
+}
+
+// webhookDeduper remembers every status delivered for each order so
+// retried or reordered notifications reach the listeners only once
+type webhookDeduper struct {
+	mu   sync.Mutex
+	seen map[uint]*dedupeEntry
+}
+
+type dedupeEntry struct {
+	statuses map[string]bool
+	terminal bool      // A terminal status was delivered
+	at       time.Time // Last notification
+}
+
+var paymentWebhooks = &webhookDeduper{seen: make(map[uint]*dedupeEntry)}
+
+// first records a notification and reports whether it is new. A status
+// already delivered for the order is a duplicate, and so is an open
+// status arriving after a terminal one. Orders not notified for
+// webhookDedupeWindow are forgotten.
+func (d *webhookDeduper) first(orderID uint, status string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, entry := range d.seen {
+		if now.Sub(entry.at) > webhookDedupeWindow {
+			delete(d.seen, id)
+		}
+	}
+	entry, ok := d.seen[orderID]
+	if !ok {
+		entry = &dedupeEntry{statuses: make(map[string]bool)}
+		d.seen[orderID] = entry
+	}
+	entry.at = now
+	if entry.statuses[status] || (entry.terminal && !isTerminalStatus(status)) {
+		return false
+	}
+	entry.statuses[status] = true
+	entry.terminal = entry.terminal || isTerminalStatus(status)
+	return true
+}
+
+// handlePaymentWebhook receives payment notifications from the login
+// service. Duplicates are acknowledged without being delivered again.
+func handlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.WebhookSecret == "" {
+		writeError(w, newAPIError(http.StatusNotFound, "未配置 webhook_secret，支付回调已禁用"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+	if err != nil {
+		writeError(w, newAPIError(http.StatusRequestEntityTooLarge, "请求体过大"))
+		return
+	}
+	now := time.Now()
+	if err := verifyWebhook(cfg.WebhookSecret, r.Header, body, now); err != nil {
+		log.Printf("拒绝来自 %s 的支付回调: %v", clientIP(r), err)
+		writeError(w, err)
+		return
+	}
+
+	var n paymentNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		writeError(w, errInvalidBody)
+		return
+	}
+	if n.OrderID == 0 || n.Status == "" {
+		writeError(w, newAPIError(http.StatusBadRequest, "order_id 和 status 不能为空"))
+		return
+	}
+
+	if !paymentWebhooks.first(n.OrderID, n.Status, now) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":   true,
+			"duplicate": true,
+		})
+		return
+	}
+
+	log.Printf("收到支付回调: 订单 %d (%s) 状态 %s", n.OrderID, n.OrderNo, n.Status)
+	notifyPaymentListeners(n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// cacheNotifiedOrder applies a notification to the cached copy of the
+// order, storing a new record when the order is not cached yet
+func cacheNotifiedOrder(n paymentNotification) {
+	cfg := currentConfig()
+	if localStore == nil || cfg.UserID == 0 {
+		return
+	}
+
+	order := PaymentOrder{
+		ID:          n.OrderID,
+		OrderNo:     n.OrderNo,
+		ProductType: n.ProductType,
+		Amount:      n.Amount,
+		CreatedAt:   time.Now(),
+	}
+	cached, err := localStore.get(cfg.UserID, bucketPaymentOrders, n.OrderID)
+	if err == nil && cached != nil {
+		json.Unmarshal(cached, &order)
+	}
+	if isTerminalStatus(order.Status) && !isTerminalStatus(n.Status) {
+		return // A late notification must not reopen a settled order
+	}
+	order.Status = n.Status
+	if n.PaidAt != nil {
+		order.PaidAt = n.PaidAt
+	}
+	order.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(order)
+	if err == nil {
+		err = localStore.put(cfg.UserID, bucketPaymentOrders, []json.RawMessage{data})
+	}
+	if err != nil {
+		log.Printf("缓存订单 %d 失败: %v", n.OrderID, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	const secret = "s3cret"
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"order_id":1,"status":"paid"}`)
+	signed := func(ts int64, sig string) http.Header {
+		h := http.Header{}
+		h.Set(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+		h.Set(webhookSignatureHeader, sig)
+		return h
+	}
+	valid := func(ts int64) http.Header { return signed(ts, signWebhook(secret, ts, body)) }
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		ok     bool
+	}{
+		{"valid", valid(now.Unix()), body, true},
+		{"skew inside window", valid(now.Add(-webhookMaxClockSkew).Unix()), body, true},
+		{"clock ahead inside window", valid(now.Add(webhookMaxClockSkew).Unix()), body, true},
+		{"too old", valid(now.Add(-webhookMaxClockSkew - time.Second).Unix()), body, false},
+		{"too far ahead", valid(now.Add(webhookMaxClockSkew + time.Second).Unix()), body, false},
+		{"missing timestamp", http.Header{webhookSignatureHeader: {signWebhook(secret, now.Unix(), body)}}, body, false},
+		{"malformed timestamp", http.Header{webhookTimestampHeader: {"yesterday"}, webhookSignatureHeader: {signWebhook(secret, now.Unix(), body)}}, body, false},
+		{"missing signature", signed(now.Unix(), ""), body, false},
+		{"wrong secret", signed(now.Unix(), signWebhook("other", now.Unix(), body)), body, false},
+		{"tampered body", valid(now.Unix()), []byte(`{"order_id":1,"status":"paid "}`), false},
+		{"signature for another timestamp", signed(now.Unix(), signWebhook(secret, now.Unix()-1, body)), body, false},
+		{"missing prefix", signed(now.Unix(), signWebhook(secret, now.Unix(), body)[len(webhookSignaturePrefix):]), body, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyWebhook(secret, tt.header, tt.body, now)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verifyWebhook() error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && errorStatus(err) != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", errorStatus(err))
+			}
+		})
+	}
+}
+
+func TestWebhookDeduperFirst(t *testing.T) {
+	type delivery struct {
+		order  uint
+		status string
+		after  time.Duration // Since the first delivery
+		want   bool
+	}
+	tests := []struct {
+		name       string
+		deliveries []delivery
+	}{
+		{"retry is a duplicate", []delivery{
+			{1, orderPending, 0, true},
+			{1, orderPending, time.Minute, false},
+		}},
+		{"status change is new", []delivery{
+			{1, orderPending, 0, true},
+			{1, orderPaid, time.Minute, true},
+			{1, orderPaid, 2 * time.Minute, false},
+		}},
+		{"late pending after paid", []delivery{
+			{1, orderPaid, 0, true},
+			{1, orderPending, time.Minute, false},
+		}},
+		{"earlier status repeated after a change", []delivery{
+			{1, orderPending, 0, true},
+			{1, orderPaid, time.Minute, true},
+			{1, orderPending, 2 * time.Minute, false},
+		}},
+		{"orders are independent", []delivery{
+			{1, orderPaid, 0, true},
+			{2, orderPaid, 0, true},
+			{2, orderPending, 0, false},
+		}},
+		{"forgotten after the window", []delivery{
+			{1, orderPaid, 0, true},
+			{1, orderPaid, webhookDedupeWindow + time.Second, true},
+		}},
+		{"window restarts with each delivery", []delivery{
+			{1, orderPaid, 0, true},
+			{1, orderPaid, webhookDedupeWindow - time.Second, false},
+			{1, orderPaid, webhookDedupeWindow + time.Second, false},
+		}},
+	}
+	start := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &webhookDeduper{seen: make(map[uint]*dedupeEntry)}
+			for i, dl := range tt.deliveries {
+				if got := d.first(dl.order, dl.status, start.Add(dl.after)); got != dl.want {
+					t.Errorf("delivery %d (order %d %s) first = %v, want %v", i, dl.order, dl.status, got, dl.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheNotifiedOrder(t *testing.T) {
+	store, err := openHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	localStore = store
+	defer func() { localStore = nil }()
+	prev := currentConfig()
+	cfg := *prev
+	cfg.UserID = 7
+	configPtr.Store(&cfg)
+	defer configPtr.Store(prev)
+
+	tests := []struct {
+		name   string
+		cached string // Status already cached, empty for none
+		notify string
+		want   string
+	}{
+		{"new order", "", orderPending, orderPending},
+		{"pending to paid", orderPending, orderPaid, orderPaid},
+		{"late pending after paid", orderPaid, orderPending, orderPaid},
+		{"late pending after expiry", orderExpired, orderPending, orderExpired},
+		{"terminal to terminal", orderPending, orderFailed, orderFailed},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := uint(i + 1)
+			if tt.cached != "" {
+				data, _ := json.Marshal(PaymentOrder{ID: id, OrderNo: "PAY", Status: tt.cached})
+				if err := store.put(cfg.UserID, bucketPaymentOrders, []json.RawMessage{data}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cacheNotifiedOrder(paymentNotification{OrderID: id, OrderNo: "PAY", Status: tt.notify})
+
+			raw, err := store.get(cfg.UserID, bucketPaymentOrders, id)
+			if err != nil || raw == nil {
+				t.Fatalf("get = %s, %v", raw, err)
+			}
+			var order PaymentOrder
+			json.Unmarshal(raw, &order)
+			if order.Status != tt.want {
+				t.Errorf("cached status = %q, want %q", order.Status, tt.want)
+			}
+		})
+	}
+}